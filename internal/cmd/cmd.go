@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 
@@ -85,6 +86,21 @@ func Main() {
 		options.ForwardRules = append(options.ForwardRules, fileRules...)
 	}
 
+	for name, filePath := range options.ForwardRouteFiles {
+		fileRules, err := loadRulesFromFile(filePath)
+		if err != nil {
+			log.Fatalf("cmd: failed to load forward routes for %s from %s: %v", name, filePath, err)
+		}
+
+		if options.ForwardRoutes == nil {
+			options.ForwardRoutes = map[string]string{}
+		}
+
+		for _, rule := range fileRules {
+			options.ForwardRoutes[rule] = name
+		}
+	}
+
 	if options.DNSRedirectRulesFile != "" {
 		fileRules, err := loadRulesFromFile(options.DNSRedirectRulesFile)
 		if err != nil {
@@ -109,9 +125,68 @@ func Main() {
 		options.DropRules = append(options.DropRules, fileRules...)
 	}
 
+	listeners := clientListeners(options)
+	options.ClientAllow = loadClientRules(listeners, options.ClientAllow, options.ClientAllowFiles, true)
+	options.ClientDeny = loadClientRules(listeners, options.ClientDeny, options.ClientDenyFiles, false)
+
 	run(options)
 }
 
+// loadClientRules loads CIDRs from the files that are mapped to the listener
+// names and appends them to the comma-separated lists of rules.  listeners are
+// the valid listener names.  Unlike the other rules files, missing client
+// rules files are fatal, and so are empty lists if isAllow is true, since the
+// listener would accept every client otherwise.
+func loadClientRules(
+	listeners []string,
+	rules map[string]string,
+	files map[string]string,
+	isAllow bool,
+) (res map[string]string) {
+	res = map[string]string{}
+	for listener, list := range rules {
+		if !slices.Contains(listeners, listener) {
+			log.Fatalf("cmd: unknown listener %q in client rules", listener)
+		}
+
+		res[listener] = list
+	}
+
+	for listener, filePath := range files {
+		if !slices.Contains(listeners, listener) {
+			log.Fatalf("cmd: unknown listener %q in client rules files", listener)
+		}
+
+		if _, err := os.Stat(filePath); err != nil {
+			log.Fatalf("cmd: failed to load client rules for %s: %v", listener, err)
+		}
+
+		fileRules, err := loadRulesFromFile(filePath)
+		if err != nil {
+			log.Fatalf("cmd: failed to load client rules for %s from %s: %v", listener, filePath, err)
+		}
+
+		list := res[listener]
+		if list != "" && len(fileRules) > 0 {
+			list += ","
+		}
+
+		res[listener] = list + strings.Join(fileRules, ",")
+	}
+
+	if !isAllow {
+		return res
+	}
+
+	for listener, list := range res {
+		if strings.Trim(list, ", ") == "" {
+			log.Fatalf("cmd: client allow list of listener %s has no entries", listener)
+		}
+	}
+
+	return res
+}
+
 // Proxy is an interface that combines Start and Close methods.
 type Proxy interface {
 	Start() error
@@ -135,9 +210,11 @@ func run(options *Options) {
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChannel
 
+	// Stop the SNI proxy first so that the DNS server keeps serving the
+	// clients while their active tunnels are draining.
 	log.Info("cmd: stopping gorao")
-	log.OnCloserError(dnsProxy, log.INFO)
 	log.OnCloserError(gorao, log.INFO)
+	log.OnCloserError(dnsProxy, log.INFO)
 }
 
 // newDNSProxy creates a new instance of [*dnsproxy.DNSProxy] or panics if any
@@ -3,6 +3,8 @@ package cmd
 import (
 	"encoding/json"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // Options represents console arguments.
@@ -21,6 +23,11 @@ type Options struct {
 	// queries that are not rewritten to the SNI proxy.
 	DNSUpstream string `long:"dns-upstream" description:"The address of the DNS server the proxy will forward queries that are not rewritten by gorao." yaml:"dns_upstream"`
 
+	// BackendDNSUpstream is the address of the DNS server the SNI proxy uses
+	// to resolve the hostnames of the backends.  If not set, DNSUpstream is
+	// used.
+	BackendDNSUpstream string `long:"backend-dns-upstream" description:"The address of the DNS server the SNI proxy uses to resolve backend hostnames. If not set, dns-upstream is used." yaml:"backend_dns_upstream"`
+
 	// DNSRedirectIPV4To is the IPv4 address of the SNI proxy domains will be
 	// redirected to by rewriting responses to A queries.
 	DNSRedirectIPV4To string `long:"dns-redirect-ipv4-to" description:"IPv4 address that will be used for redirecting type A DNS queries." yaml:"dns_redirect_ipv4_to"`
@@ -39,6 +46,11 @@ type Options struct {
 	// should be dropped.  Can be specified multiple times.
 	DNSDropRules []string `long:"dns-drop-rule" description:"Wildcard that defines DNS queries to which domains should be dropped. Can be specified multiple times." yaml:"dns_drop_rules"`
 
+	// DNSDropActions maps wildcards to the ways the matching DNS queries are
+	// dropped: hang, rst (REFUSED), fin (SERVFAIL) or trickle (delayed
+	// response).  Can be specified multiple times.
+	DNSDropActions map[string]string `long:"dns-drop-action" description:"Drops DNS queries to domains that match the wildcard: hang (no response), rst (REFUSED), fin (SERVFAIL) or trickle (response delayed for the drop period), optionally followed by :duration for hang and trickle. Example: *.example.org:rst. Can be specified multiple times." yaml:"dns_drop_actions"`
+
 	// DNSCacheEnabled enables DNS response caching.
 	DNSCacheEnabled bool `long:"dns-cache-enabled" description:"Enable DNS response caching." yaml:"dns_cache_enabled"`
 
@@ -57,15 +69,77 @@ type Options struct {
 	// that was specified in the "Host" header.
 	HTTPListenAddress string `long:"http-address" description:"IP address the SNI proxy server will be listening for plain HTTP connections." yaml:"http_address"`
 
-	// HTTPPort is the port the HTTP proxy server will be listening to.
-	HTTPPort int `long:"http-port" description:"Port the SNI proxy server will be listening for plain HTTP connections." yaml:"http_port"`
+	// HTTPPort is the port the HTTP proxy server will be listening to.  If
+	// zero, the listener is disabled.
+	HTTPPort int `long:"http-port" description:"Port the SNI proxy server will be listening for plain HTTP connections. 0 disables the listener." yaml:"http_port"`
 
 	// TLSListenAddress is the IP address the SNI proxy server will be
 	// listening to.
 	TLSListenAddress string `long:"tls-address" description:"IP address the SNI proxy server will be listening for TLS connections." yaml:"tls_address"`
 
-	// TLSPort is the port the SNI proxy server will be listening to.
-	TLSPort int `long:"tls-port" description:"Port the SNI proxy server will be listening for TLS connections." yaml:"tls_port"`
+	// TLSPort is the port the SNI proxy server will be listening to.  If
+	// zero, the listener is disabled.
+	TLSPort int `long:"tls-port" description:"Port the SNI proxy server will be listening for TLS connections. 0 disables the listener." yaml:"tls_port"`
+
+	// Listeners is a map of additional SNI proxy listeners.  The key is the
+	// name of the listener, the value is its URL that defines the protocol,
+	// the listen address and the options, for instance
+	// "tls://0.0.0.0:993?dest_port=993&proxy_protocol=optional".  The
+	// transparent parameter (redirect or tproxy) enables transparent proxying.
+	// The quic scheme listens for QUIC (HTTP/3) over UDP, the connect and
+	// socks5 schemes are explicit HTTP and SOCKS5 proxies with optional
+	// credentials in the userinfo.  The http_mode
+	// parameter of http listeners works the same way as HTTPMode.
+	Listeners map[string]string `long:"listener" description:"Named SNI proxy listener: tls, http, quic, connect or socks5 URL with optional dest_port, proxy_protocol, transparent (redirect or tproxy) and http_mode (tunnel or request) parameters. Example: imaps:tls://0.0.0.0:993?dest_port=993. Can be specified multiple times." yaml:"listeners"`
+
+	// TLSProxyProtocol defines how the TLS listener handles PROXY protocol
+	// headers sent by a load balancer.
+	TLSProxyProtocol string `long:"tls-proxy-protocol" description:"PROXY protocol mode of the TLS listener: off, optional or require." yaml:"tls_proxy_protocol"`
+
+	// HTTPProxyProtocol defines how the plain HTTP listener handles PROXY
+	// protocol headers sent by a load balancer.
+	HTTPProxyProtocol string `long:"http-proxy-protocol" description:"PROXY protocol mode of the plain HTTP listener: off, optional or require." yaml:"http_proxy_protocol"`
+
+	// HTTPMode defines how the plain HTTP listener handles the requests of a
+	// single connection: tunnel routes the whole connection by the first
+	// request, request applies the rules to every request.
+	HTTPMode string `long:"http-mode" description:"Mode of the plain HTTP listener: tunnel (the first request chooses the backend of the whole connection) or request (every request is routed separately)." yaml:"http_mode"`
+
+	// HTTPIdleTimeout is the time gorao waits for the next request on a
+	// keep-alive connection of the plain HTTP listeners in the request mode.
+	HTTPIdleTimeout time.Duration `long:"http-idle-timeout" description:"Time to wait for the next request on a keep-alive connection of the plain HTTP listeners in the request mode. Example: 2m." yaml:"http_idle_timeout"`
+
+	// HTTPMaxBackends is the maximum number of backend connections a single
+	// client connection of the plain HTTP listeners in the request mode
+	// keeps.
+	HTTPMaxBackends int `long:"http-max-backends" description:"Maximum number of backend connections a single client connection of the plain HTTP listeners in the request mode keeps, the least recently used one is closed to open another one. Example: 8." yaml:"http_max_backends"`
+
+	// ProxyProtocolTrusted is a list of CIDRs that are allowed to send PROXY
+	// protocol headers.  Required if any listener parses PROXY protocol.
+	ProxyProtocolTrusted []string `long:"proxy-protocol-trusted" description:"CIDR or IP address that is allowed to send PROXY protocol headers. Can be specified multiple times. Required if PROXY protocol is enabled on any listener." yaml:"proxy_protocol_trusted"`
+
+	// ProxyProtocolRules is a map that defines which PROXY protocol version
+	// header is sent to the backends for connections that match the rules.
+	ProxyProtocolRules map[string]string `long:"proxy-protocol-rule" description:"Sends a PROXY protocol header with the client address to backends that match the wildcard. Example: example.*:v2. Can be specified multiple times." yaml:"proxy_protocol_rules"`
+
+	// ClientAllow maps listener names (dns, dot, doh, doq, tls, http or the
+	// name of a listener from Listeners) to comma-separated lists of CIDRs the
+	// clients are allowed from.  If there is no list for a listener, all
+	// clients are allowed.
+	ClientAllow map[string]string `long:"client-allow" description:"Comma-separated CIDRs the clients of the listener (dns, dot, doh, doq, tls, http or a named one) are allowed from. Example: dns:10.0.0.0/8,192.168.0.0/16. Can be specified multiple times." yaml:"client_allow"`
+
+	// ClientAllowFiles maps listener names to the paths of CSV files with
+	// CIDRs the clients are allowed from (one CIDR per line).
+	ClientAllowFiles map[string]string `long:"client-allow-file" description:"Path to CSV file with CIDRs the clients of the listener are allowed from (one CIDR per line). Example: tls:clients-allow.csv. Can be specified multiple times." yaml:"client_allow_files"`
+
+	// ClientDeny maps listener names (dns, dot, doh, doq, tls, http or the
+	// name of a listener from Listeners) to comma-separated lists of CIDRs the
+	// clients are denied from.  Has higher priority than ClientAllow.
+	ClientDeny map[string]string `long:"client-deny" description:"Comma-separated CIDRs the clients of the listener (dns, dot, doh, doq, tls, http or a named one) are denied from. Example: tls:203.0.113.0/24. Can be specified multiple times." yaml:"client_deny"`
+
+	// ClientDenyFiles maps listener names to the paths of CSV files with
+	// CIDRs the clients are denied from (one CIDR per line).
+	ClientDenyFiles map[string]string `long:"client-deny-file" description:"Path to CSV file with CIDRs the clients of the listener are denied from (one CIDR per line). Example: dns:clients-deny.csv. Can be specified multiple times." yaml:"client_deny_files"`
 
 	// DOTListenAddress is the IP address the DNS proxy server will be
 	// listening for DNS-over-TLS connections.
@@ -119,6 +193,50 @@ type Options struct {
 	// ForwardRulesFile is the path to a CSV file containing forward rules (one pattern per line).
 	ForwardRulesFile string `long:"forward-rules-file" description:"Path to CSV file with forward rules (one pattern per line)." yaml:"forward_rules_file"`
 
+	// ForwardProxies is a map of named SOCKS/HTTP/HTTPS proxies.  The key is
+	// the upstream name that is used in ForwardRoutes, the value is the proxy
+	// URL.  Several comma-separated URLs make a pool of proxies.
+	ForwardProxies map[string]string `long:"forward-proxies" description:"Named SOCKS/HTTP/HTTPS proxy. Several comma-separated URLs make a pool. Example: bd-socks:socks5://127.0.0.1:1080. Can be specified multiple times." yaml:"forward_proxies"`
+
+	// ForwardPoolStrategies maps the names of the proxy pools to the
+	// strategies used to choose a proxy: round-robin, least-conn or priority.
+	ForwardPoolStrategies map[string]string `long:"forward-pool-strategy" description:"Strategy of choosing a proxy from the named pool: round-robin, least-conn or priority. Example: bd-socks:priority. Can be specified multiple times." yaml:"forward_pool_strategies"`
+
+	// ForwardHealthCheckInterval is the interval between active health checks
+	// of the proxies in the pools.
+	ForwardHealthCheckInterval time.Duration `long:"forward-health-check-interval" description:"Interval between active health checks of the proxies in the pools. If not set, only failed connections mark proxies down. Example: 30s." yaml:"forward_health_check_interval"`
+
+	// ForwardHealthCheckProbe is the host:port that health checks connect to
+	// through the proxies.
+	ForwardHealthCheckProbe string `long:"forward-health-check-probe" description:"host:port that health checks connect to through the proxies. If not set, health checks just connect to the proxies." yaml:"forward_health_check_probe"`
+
+	// ForwardRoutes is a map of wildcards to the names of the upstreams from
+	// ForwardProxies.  "direct" means that the connection is not forwarded.
+	ForwardRoutes map[string]string `long:"forward-route" description:"Forwards connections to domains that match the wildcard to the named proxy or \"direct\". Example: *.example.org:bd-socks. Can be specified multiple times." yaml:"forward_routes"`
+
+	// ForwardRouteFiles is a map of upstream names to the paths of CSV files
+	// with wildcards (one pattern per line) that should be routed to them.
+	ForwardRouteFiles map[string]string `long:"forward-route-file" description:"Path to CSV file with wildcards that are forwarded to the named proxy. Example: bd-socks:domains-bd.csv. Can be specified multiple times." yaml:"forward_route_files"`
+
+	// OriginalDstRules is a list of wildcards that define which connections
+	// accepted by the transparent listeners are tunneled to their original
+	// destination address instead of the server name.
+	OriginalDstRules []string `long:"original-dst-rule" description:"Wildcard that defines which connections accepted by the transparent listeners are tunneled to their original destination IP instead of the server name. Can be specified multiple times." yaml:"original_dst_rules"`
+
+	// NoServerNameAction defines what happens to the TLS connections without
+	// SNI or with an IP address in SNI and to the plain HTTP requests without
+	// the Host header: reject, backend or original-dst.
+	NoServerNameAction string `long:"no-server-name-action" description:"What to do with connections without SNI or Host header: reject, backend (tunnel to no-server-name-backend) or original-dst (tunnel to the original destination of transparent listeners, then to the backend if set). Default: original-dst." yaml:"no_server_name_action"`
+
+	// NoServerNameBackend is the host:port the connections without a server
+	// name are tunneled to.
+	NoServerNameBackend string `long:"no-server-name-backend" description:"host:port the connections without SNI or Host header are tunneled to." yaml:"no_server_name_backend"`
+
+	// BackendRules is a map of wildcards to the backend addresses the
+	// matching connections are tunneled to instead of the requested host:
+	// host:port, an IP address or host without port, or unix:/path.
+	BackendRules map[string]string `long:"backend-rule" description:"Tunnels connections to domains that match the wildcard to the fixed backend: host:port, IP address or host without port, or unix:/path/to/socket. Example: *.internal.example.com:10.0.0.5:443. Can be specified multiple times." yaml:"backend_rules"`
+
 	// DNSRedirectRulesFile is the path to a CSV file containing DNS redirect rules (one pattern per line).
 	DNSRedirectRulesFile string `long:"dns-redirect-rules-file" description:"Path to CSV file with DNS redirect rules (one pattern per line)." yaml:"dns_redirect_rules_file"`
 
@@ -129,14 +247,118 @@ type Options struct {
 	// BlockRulesFile is the path to a CSV file containing block rules (one pattern per line).
 	BlockRulesFile string `long:"block-rules-file" description:"Path to CSV file with block rules (one pattern per line)." yaml:"block_rules_file"`
 
+	// BlockResponses maps wildcards to the ways the matching blocked
+	// connections are rejected.  Can be specified multiple times.
+	BlockResponses map[string]string `long:"block-response" description:"Rejects blocked connections to domains that match the wildcard with: close, rst (TCP reset), access_denied or unrecognized_name (TLS alert). Example: *.example.org:access_denied. Can be specified multiple times." yaml:"block_responses"`
+
+	// BlockPageStatus is the status code of the response to the blocked plain
+	// HTTP requests, e.g. 403 or 451.
+	BlockPageStatus int `long:"block-page-status" description:"Status code of the response to the blocked plain HTTP requests, e.g. 403 or 451. If no block page option is set, such connections are closed without a response." yaml:"block_page_status"`
+
+	// BlockPageTemplate is the path to the HTML template of the response body
+	// to the blocked plain HTTP requests.
+	BlockPageTemplate string `long:"block-page-template" description:"Path to the HTML template of the response to the blocked plain HTTP requests. {{.Host}} and {{.Rule}} are replaced with the requested host and the matched block rule." yaml:"block_page_template"`
+
+	// BlockPageRedirect is the URL the blocked plain HTTP requests are
+	// redirected to.
+	BlockPageRedirect string `long:"block-page-redirect" description:"URL the blocked plain HTTP requests are redirected to." yaml:"block_page_redirect"`
+
 	// DropRules is a list of wildcards that define connections to which hosts
 	// will be "dropped".  "Dropped" means that the connection will be delayed
-	// for a hard-coded period of 3 minutes.
-	DropRules []string `long:"drop-rule" description:"Wildcard that defines connections to which domains should be dropped (i.e. delayed for a hard-coded period of 3 minutes. Can be specified multiple times." yaml:"drop_rules"`
+	// for DropPeriod.
+	DropRules []string `long:"drop-rule" description:"Wildcard that defines connections to which domains should be dropped (i.e. delayed for the drop period). Can be specified multiple times." yaml:"drop_rules"`
+
+	// DropActions maps wildcards to the ways the matching connections are
+	// dropped: hang, rst, fin or trickle.  Can be specified multiple times.
+	DropActions map[string]string `long:"drop-action" description:"Drops connections to domains that match the wildcard: hang (delay and close), rst (TCP reset), fin (clean close) or trickle (tunnel a few bytes per second), optionally followed by :duration for hang and trickle. QUIC datagrams are discarded whatever the action is. Example: *.example.org:trickle:30s. Can be specified multiple times." yaml:"drop_actions"`
+
+	// DropPeriod is the time the dropped connections hang or trickle unless
+	// their drop action specifies another one.
+	DropPeriod time.Duration `long:"drop-period" description:"Time the dropped connections hang or trickle and the trickled DNS queries are delayed. Example: 3m." yaml:"drop_period"`
+
+	// Faults maps wildcards to the comma-separated lists of faults injected
+	// into the matching tunnels with their probabilities.  Can be specified
+	// multiple times.
+	Faults map[string]string `long:"fault" description:"Injects faults into the tunnels to domains that match the wildcard: reset-bytes:N, reset-after:duration, stall:duration, truncate:N, dial-error[:refused|reset|unreachable|timeout] or corrupt[:N], each optionally followed by @percent and separated by commas. Example: *.example.org:reset-bytes:4096@10,stall:2s@25. Can be specified multiple times." yaml:"faults"`
+
+	// FaultSeed seeds the random choice of the injected faults so that the
+	// test runs can be reproduced.  If not set, a random seed is logged.
+	FaultSeed uint64 `long:"fault-seed" description:"Seed of the random choice of the injected faults. If not set, a random seed is used and logged." yaml:"fault_seed"`
 
 	// DropRulesFile is the path to a CSV file containing drop rules (one pattern per line).
 	DropRulesFile string `long:"drop-rules-file" description:"Path to CSV file with drop rules (one pattern per line)." yaml:"drop_rules_file"`
 
+	// ReadTimeout is the time gorao waits for the first bytes of a new client
+	// connection.
+	ReadTimeout time.Duration `long:"read-timeout" description:"Time to wait for the ClientHello, the HTTP request headers or the proxy handshake of a new client connection. Example: 10s." yaml:"read_timeout"`
+
+	// ReadTimeoutRules maps wildcards to the read timeouts of the requests to
+	// the matching domains in the request mode.  Can be specified multiple
+	// times.
+	ReadTimeoutRules map[string]time.Duration `long:"read-timeout-rule" description:"Time the client has to send every chunk of the request body and the rest of the next request headers within after a request to the domains that match the wildcard in the request mode. Example: *.example.org:2s. Can be specified multiple times." yaml:"read_timeout_rules"`
+
+	// BackendResponseTimeoutRules maps wildcards to the time the backends of
+	// the matching domains have to send the first bytes of their response
+	// within.  Can be specified multiple times.
+	BackendResponseTimeoutRules map[string]time.Duration `long:"backend-response-timeout-rule" description:"Time the backends of the domains that match the wildcard have to send the first bytes of their response within, e.g. the TLS ServerHello or the HTTP response headers. Example: *.example.org:2s. Can be specified multiple times." yaml:"backend_response_timeout_rules"`
+
+	// ConnectTimeout is the timeout for connecting to the backends.
+	ConnectTimeout time.Duration `long:"connect-timeout" description:"Timeout for connecting to the backends, including the handshakes with the forward proxies. Example: 10s." yaml:"connect_timeout"`
+
+	// ConnectTimeoutRules maps wildcards to the connect timeouts of the
+	// matching domains.  Can be specified multiple times.
+	ConnectTimeoutRules map[string]time.Duration `long:"connect-timeout-rule" description:"Timeout for connecting to the domains that match the wildcard. Example: *.example.org:30s. Can be specified multiple times." yaml:"connect_timeout_rules"`
+
+	// TunnelIdleTimeout is the time after which a tunnel without traffic in
+	// either direction is closed.
+	TunnelIdleTimeout time.Duration `long:"tunnel-idle-timeout" description:"Time after which a tunnel without traffic in either direction is closed. If not set, there is no timeout. Example: 5m." yaml:"tunnel_idle_timeout"`
+
+	// TunnelIdleTimeoutRules maps wildcards to the idle timeouts of the
+	// tunnels to the matching domains.  Can be specified multiple times.
+	TunnelIdleTimeoutRules map[string]time.Duration `long:"tunnel-idle-timeout-rule" description:"Idle timeout of the tunnels to the domains that match the wildcard, 0s disables it. Example: *.example.org:1h. Can be specified multiple times." yaml:"tunnel_idle_timeout_rules"`
+
+	// TunnelMaxLifetime is the time after which a tunnel is closed regardless
+	// of its activity.
+	TunnelMaxLifetime time.Duration `long:"tunnel-max-lifetime" description:"Time after which a tunnel is closed regardless of its activity. If not set, there is no limit. Example: 24h." yaml:"tunnel_max_lifetime"`
+
+	// TunnelMaxLifetimeRules maps wildcards to the maximum lifetimes of the
+	// tunnels to the matching domains.  Can be specified multiple times.
+	TunnelMaxLifetimeRules map[string]time.Duration `long:"tunnel-max-lifetime-rule" description:"Maximum lifetime of the tunnels to the domains that match the wildcard, 0s disables it. Example: *.example.org:10m. Can be specified multiple times." yaml:"tunnel_max_lifetime_rules"`
+
+	// KeepAlive is the TCP keepalive period of both sides of the tunnels.
+	KeepAlive time.Duration `long:"keepalive" description:"TCP keepalive period of both the client and the backend connections of the tunnels. If not set, the system default is used, a negative value disables keepalive. Example: 30s." yaml:"keepalive"`
+
+	// KeepAliveRules maps wildcards to the TCP keepalive periods of the
+	// tunnels to the matching domains.  Can be specified multiple times.
+	KeepAliveRules map[string]time.Duration `long:"keepalive-rule" description:"TCP keepalive period of the tunnels to the domains that match the wildcard. Example: *.example.org:10s. Can be specified multiple times." yaml:"keepalive_rules"`
+
+	// MaxConns is the maximum number of concurrent client connections.
+	MaxConns int `long:"max-conns" description:"Maximum number of concurrent client connections. If not set, there is no limit." yaml:"max_conns"`
+
+	// MaxConnsAction is the way the connections over MaxConns are rejected.
+	MaxConnsAction string `long:"max-conns-action" description:"How the connections over max-conns are rejected: close or rst." yaml:"max_conns_action"`
+
+	// MaxClientConns is the maximum number of concurrent connections from a
+	// single client IP address.
+	MaxClientConns int `long:"max-client-conns" description:"Maximum number of concurrent connections from a single client IP address. If not set, there is no limit." yaml:"max_client_conns"`
+
+	// MaxClientConnsAction is the way the connections over MaxClientConns are
+	// rejected.
+	MaxClientConnsAction string `long:"max-client-conns-action" description:"How the connections over max-client-conns are rejected: close or rst." yaml:"max_client_conns_action"`
+
+	// MaxHostConns maps wildcards to the maximum numbers of concurrent
+	// connections to the domains that match them.  Can be specified multiple
+	// times.
+	MaxHostConns map[string]int `long:"max-host-conns" description:"Maximum number of concurrent connections to the domains that match the wildcard, counted together for all of them. Example: *.example.org:100. Can be specified multiple times." yaml:"max_host_conns"`
+
+	// MaxHostConnsAction is the way the connections over MaxHostConns are
+	// rejected.
+	MaxHostConnsAction string `long:"max-host-conns-action" description:"How the connections over max-host-conns are rejected: close, rst, access_denied or unrecognized_name." yaml:"max_host_conns_action"`
+
+	// DrainTimeout is the time gorao waits for the active tunnels to finish
+	// on shutdown before closing them forcibly.
+	DrainTimeout time.Duration `long:"drain-timeout" description:"Time to wait for active connections to finish on shutdown before closing them forcibly. Example: 30s." yaml:"drain_timeout"`
+
 	// Log settings
 	// --
 
@@ -152,16 +374,35 @@ type Options struct {
 func (o *Options) String() (s string) {
 	// Create a shallow copy to avoid modifying the original options
 	oCopy := *o
-	if oCopy.ForwardProxy != "" {
-		if u, err := url.Parse(oCopy.ForwardProxy); err == nil {
-			oCopy.ForwardProxy = u.Redacted()
-		}
+	oCopy.ForwardProxy = redactURL(oCopy.ForwardProxy)
+
+	oCopy.ForwardProxies = make(map[string]string, len(o.ForwardProxies))
+	for name, addr := range o.ForwardProxies {
+		oCopy.ForwardProxies[name] = redactURL(addr)
+	}
+
+	oCopy.Listeners = make(map[string]string, len(o.Listeners))
+	for name, addr := range o.Listeners {
+		oCopy.Listeners[name] = redactURL(addr)
 	}
 
 	b, _ := json.MarshalIndent(oCopy, "", "    ")
 	return string(b)
 }
 
+// redactURL returns addr with the passwords replaced.  addr may contain
+// several comma-separated URLs.
+func redactURL(addr string) (s string) {
+	urls := strings.Split(addr, ",")
+	for i, u := range urls {
+		if parsed, err := url.Parse(strings.TrimSpace(u)); err == nil {
+			urls[i] = parsed.Redacted()
+		}
+	}
+
+	return strings.Join(urls, ",")
+}
+
 // DefaultOptions returns the default options.
 func DefaultOptions() *Options {
 	return &Options{
@@ -183,5 +424,9 @@ func DefaultOptions() *Options {
 		DOHPort:           8443,
 		DOQListenAddress:  "0.0.0.0",
 		DOQPort:           8853,
+		DrainTimeout:      30 * time.Second,
+		DropPeriod:        3 * time.Minute,
+		ReadTimeout:       10 * time.Second,
+		ConnectTimeout:    10 * time.Second,
 	}
 }
@@ -3,6 +3,10 @@ package dnsproxy
 import (
 	"net"
 	"net/netip"
+	"time"
+
+	"github.com/zamibd/gorao/internal/drop"
+	"github.com/zamibd/gorao/internal/filter"
 )
 
 // Config is the DNS proxy configuration.
@@ -22,6 +26,22 @@ type Config struct {
 	// for DNS-over-QUIC connections.
 	QUICListenAddr netip.AddrPort
 
+	// ClientFilter is the access control list of the plain DNS listener.  If
+	// nil, all clients are allowed.
+	ClientFilter *filter.ClientFilter
+
+	// TLSClientFilter is the access control list of the DNS-over-TLS
+	// listener.  If nil, all clients are allowed.
+	TLSClientFilter *filter.ClientFilter
+
+	// HTTPSClientFilter is the access control list of the DNS-over-HTTPS
+	// listener.  If nil, all clients are allowed.
+	HTTPSClientFilter *filter.ClientFilter
+
+	// QUICClientFilter is the access control list of the DNS-over-QUIC
+	// listener.  If nil, all clients are allowed.
+	QUICClientFilter *filter.ClientFilter
+
 	// TLSCertFile is the path to the TLS certificate file.
 	TLSCertFile string
 
@@ -48,6 +68,17 @@ type Config struct {
 	// respond to these queries.
 	DropRules []string
 
+	// DropActions maps wildcards to the ways the matching DNS queries are
+	// dropped: hang means no response, rst means REFUSED, fin means SERVFAIL
+	// and trickle means that the response is delayed.  Has higher priority
+	// than DropRules.
+	DropActions map[string]drop.Action
+
+	// DropPeriod is the time the responses to the trickled queries are
+	// delayed for unless their action specifies another one.  If zero, 3
+	// minutes are used.
+	DropPeriod time.Duration
+
 	// CacheEnabled enables DNS response caching.
 	CacheEnabled bool
 
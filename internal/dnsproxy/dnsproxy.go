@@ -3,6 +3,7 @@
 package dnsproxy
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -10,15 +11,24 @@ import (
 	"log/slog"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
+	"github.com/zamibd/gorao/internal/drop"
 	"github.com/zamibd/gorao/internal/filter"
 )
 
-// defaultTTL is the default TTL for the rewritten records.
-const defaultTTL = 60
+const (
+	// defaultTTL is the default TTL for the rewritten records.
+	defaultTTL = 60
+
+	// defaultDropPeriod is the default time the trickled queries are delayed
+	// for.
+	defaultDropPeriod = 3 * time.Minute
+)
 
 // DNSProxy is a struct that manages the DNS proxy server.  This server's
 // purpose is to redirect queries to a specified SNI proxy.
@@ -28,6 +38,21 @@ type DNSProxy struct {
 	redirectIPv4To net.IP
 	redirectIPv6To net.IP
 	dropRules      []string
+
+	// dropActions maps wildcards to the ways the matching queries are
+	// dropped.
+	dropActions *filter.RuleMap[drop.Action]
+	dropPeriod  time.Duration
+
+	// done is closed when the proxy is closed so that the delayed queries
+	// don't hold the shutdown.
+	done chan struct{}
+
+	// closeOnce makes the repeated calls of Close no-op.
+	closeOnce sync.Once
+
+	// clientFilters are the access control lists of the listeners.
+	clientFilters map[proxy.Proto]*filter.ClientFilter
 }
 
 // type check
@@ -45,6 +70,20 @@ func New(cfg *Config) (d *DNSProxy, err error) {
 		redirectIPv4To: cfg.RedirectIPv4To,
 		redirectIPv6To: cfg.RedirectIPv6To,
 		dropRules:      cfg.DropRules,
+		dropPeriod:     cmp.Or(cfg.DropPeriod, defaultDropPeriod),
+		done:           make(chan struct{}),
+		clientFilters: map[proxy.Proto]*filter.ClientFilter{
+			proxy.ProtoUDP:   cfg.ClientFilter,
+			proxy.ProtoTCP:   cfg.ClientFilter,
+			proxy.ProtoTLS:   cfg.TLSClientFilter,
+			proxy.ProtoHTTPS: cfg.HTTPSClientFilter,
+			proxy.ProtoQUIC:  cfg.QUICClientFilter,
+		},
+	}
+
+	d.dropActions, err = filter.NewRuleMap(cfg.DropActions)
+	if err != nil {
+		return nil, fmt.Errorf("dnsproxy: drop actions: %w", err)
 	}
 
 	d.proxy, err = proxy.New(&proxyConfig)
@@ -68,13 +107,17 @@ func (d *DNSProxy) Start() (err error) {
 	return err
 }
 
-// Close implements the [io.Closer] interface for DNSProxy.
+// Close implements the [io.Closer] interface for DNSProxy.  Only the first
+// call has effect.
 func (d *DNSProxy) Close() (err error) {
-	log.Info("dnsproxy: stopping")
+	d.closeOnce.Do(func() {
+		log.Info("dnsproxy: stopping")
 
-	err = d.proxy.Shutdown(context.Background())
+		close(d.done)
+		err = d.proxy.Shutdown(context.Background())
 
-	log.Info("dnsproxy: stopped")
+		log.Info("dnsproxy: stopped")
+	})
 
 	return err
 }
@@ -87,6 +130,14 @@ func (d *DNSProxy) requestHandler(p *proxy.Proxy, ctx *proxy.DNSContext) (err er
 
 	log.Debug("dnsproxy: received DNS query %s %s", dns.Type(qType), qName)
 
+	if !d.clientFilters[ctx.Proto].Allowed(ctx.Addr.Addr()) {
+		log.Debug("dnsproxy: refusing %s query from %s", ctx.Proto, ctx.Addr)
+
+		ctx.Res = new(dns.Msg).SetRcode(ctx.Req, dns.RcodeRefused)
+
+		return nil
+	}
+
 	if qType != dns.TypeA && qType != dns.TypeAAAA {
 		// Doing nothing with the request if it's not A/AAAA, we cannot
 		// rewrite them anyway.
@@ -95,12 +146,12 @@ func (d *DNSProxy) requestHandler(p *proxy.Proxy, ctx *proxy.DNSContext) (err er
 
 	domainName := strings.TrimSuffix(qName, ".")
 
-	if filter.MatchWildcards(domainName, d.dropRules) {
-		// Return empty response, effectively "dropping" the query.
-		ctx.Res = nil
-		log.Info("dnsproxy: dropping DNS query for %s %s", dns.Type(qType), qName)
+	if a, ok := d.dropAction(domainName); ok {
+		log.Info("dnsproxy: dropping DNS query for %s %s: %s", dns.Type(qType), qName, a)
 
-		return nil
+		if !d.drop(ctx, a) {
+			return nil
+		}
 	}
 
 	if filter.MatchWildcards(domainName, d.redirectRules) {
@@ -112,6 +163,47 @@ func (d *DNSProxy) requestHandler(p *proxy.Proxy, ctx *proxy.DNSContext) (err er
 	return p.Resolve(ctx)
 }
 
+// dropAction returns the drop action for the domain name if any.  The drop
+// actions take precedence over the drop rules that always mean [drop.Hang].
+func (d *DNSProxy) dropAction(domainName string) (a drop.Action, ok bool) {
+	if a, _, ok = d.dropActions.Match(&filter.Target{Host: domainName}); ok {
+		return a, true
+	}
+
+	if filter.MatchWildcards(domainName, d.dropRules) {
+		return drop.Action{Kind: drop.Hang}, true
+	}
+
+	return drop.Action{}, false
+}
+
+// drop applies the drop action to the query.  It returns true if the query
+// must still be processed, which is the case for [drop.Trickle] after the
+// delay.
+func (d *DNSProxy) drop(ctx *proxy.DNSContext, a drop.Action) (cont bool) {
+	switch a.Kind {
+	case drop.RST:
+		ctx.Res = new(dns.Msg).SetRcode(ctx.Req, dns.RcodeRefused)
+	case drop.FIN:
+		ctx.Res = new(dns.Msg).SetRcode(ctx.Req, dns.RcodeServerFailure)
+	case drop.Trickle:
+		t := time.NewTimer(a.PeriodOr(d.dropPeriod))
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+			return true
+		case <-d.done:
+			ctx.Res = nil
+		}
+	default:
+		// Return empty response, effectively "dropping" the query.
+		ctx.Res = nil
+	}
+
+	return false
+}
+
 // rewrite rewrites the specified query and redirects the response to the
 // configured IP addresses.
 func (d *DNSProxy) rewrite(qName string, qType uint16, ctx *proxy.DNSContext) {
@@ -0,0 +1,90 @@
+// Package drop defines the ways the connections and the DNS queries matching
+// the drop rules are dropped.  They are used to emulate network failures.
+package drop
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kind is the kind of a drop action.
+type Kind string
+
+const (
+	// Hang means that the connection is kept open without any response for
+	// the drop period and then closed.  DNS queries get no response.
+	Hang Kind = "hang"
+
+	// RST means that the connection is reset with a TCP RST.  DNS queries get
+	// REFUSED.
+	RST Kind = "rst"
+
+	// FIN means that the connection is closed cleanly right after the server
+	// name is read.  DNS queries get SERVFAIL.
+	FIN Kind = "fin"
+
+	// Trickle means that the connection is tunneled at a few bytes per second
+	// for the drop period and then closed.  DNS queries are answered after the
+	// drop period.
+	Trickle Kind = "trickle"
+)
+
+// Action is the way a connection or a DNS query is dropped.
+type Action struct {
+	// Kind is the kind of the action.
+	Kind Kind
+
+	// Period is the time the connection hangs or trickles.  If zero, the
+	// global drop period is used.  It is only supported for Hang and Trickle.
+	Period time.Duration
+}
+
+// String implements the [fmt.Stringer] interface for Action.
+func (a Action) String() (s string) {
+	if a.Period == 0 {
+		return string(a.Kind)
+	}
+
+	return string(a.Kind) + ":" + a.Period.String()
+}
+
+// Parse parses the action from its string representation: the kind,
+// optionally followed by a colon and the period, e.g. "rst" or "hang:30s".
+// An empty string is mapped to Hang.
+func Parse(s string) (a Action, err error) {
+	kind, period, hasPeriod := strings.Cut(s, ":")
+
+	switch a.Kind = Kind(kind); a.Kind {
+	case "":
+		a.Kind = Hang
+	case Hang, Trickle, RST, FIN:
+		// Go on.
+	default:
+		return Action{}, fmt.Errorf("drop: unsupported action %q", s)
+	}
+
+	if !hasPeriod {
+		return a, nil
+	}
+
+	if a.Kind != Hang && a.Kind != Trickle {
+		return Action{}, fmt.Errorf("drop: action %q does not support period", kind)
+	}
+
+	a.Period, err = time.ParseDuration(period)
+	if err != nil || a.Period <= 0 {
+		return Action{}, fmt.Errorf("drop: bad period in action %q", s)
+	}
+
+	return a, nil
+}
+
+// PeriodOr returns the period of the action or def if it's not set.
+func (a Action) PeriodOr(def time.Duration) (d time.Duration) {
+	if a.Period == 0 {
+		return def
+	}
+
+	return a.Period
+}
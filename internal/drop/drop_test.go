@@ -0,0 +1,110 @@
+package drop_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zamibd/gorao/internal/drop"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		want    drop.Action
+		wantErr bool
+	}{{
+		name: "empty",
+		in:   "",
+		want: drop.Action{Kind: drop.Hang},
+	}, {
+		name: "hang",
+		in:   "hang",
+		want: drop.Action{Kind: drop.Hang},
+	}, {
+		name: "hang_period",
+		in:   "hang:30s",
+		want: drop.Action{Kind: drop.Hang, Period: 30 * time.Second},
+	}, {
+		name: "trickle_period",
+		in:   "trickle:1m",
+		want: drop.Action{Kind: drop.Trickle, Period: time.Minute},
+	}, {
+		name: "rst",
+		in:   "rst",
+		want: drop.Action{Kind: drop.RST},
+	}, {
+		name: "fin",
+		in:   "fin",
+		want: drop.Action{Kind: drop.FIN},
+	}, {
+		name:    "unknown",
+		in:      "drop",
+		wantErr: true,
+	}, {
+		name:    "upper_case",
+		in:      "RST",
+		wantErr: true,
+	}, {
+		name:    "rst_period",
+		in:      "rst:10s",
+		wantErr: true,
+	}, {
+		name:    "fin_period",
+		in:      "fin:10s",
+		wantErr: true,
+	}, {
+		name:    "empty_period",
+		in:      "hang:",
+		wantErr: true,
+	}, {
+		name:    "bad_period",
+		in:      "hang:forever",
+		wantErr: true,
+	}, {
+		name:    "zero_period",
+		in:      "trickle:0s",
+		wantErr: true,
+	}, {
+		name:    "negative_period",
+		in:      "hang:-1s",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := drop.Parse(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %v", a)
+				}
+
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if a != tc.want {
+				t.Fatalf("got %+v, want %+v", a, tc.want)
+			}
+
+			// The string representation must be parsed back to the same action.
+			if got, err := drop.Parse(a.String()); err != nil || got != a {
+				t.Fatalf("round trip of %q: got %+v, %v", a, got, err)
+			}
+		})
+	}
+}
+
+func TestAction_PeriodOr(t *testing.T) {
+	const def = 5 * time.Second
+
+	if got := (drop.Action{Kind: drop.Hang}).PeriodOr(def); got != def {
+		t.Errorf("got %v, want %v", got, def)
+	}
+
+	a := drop.Action{Kind: drop.Trickle, Period: time.Second}
+	if got := a.PeriodOr(def); got != time.Second {
+		t.Errorf("got %v, want %v", got, time.Second)
+	}
+}
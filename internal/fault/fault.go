@@ -0,0 +1,188 @@
+// Package fault defines the faults injected into the tunnels matching the
+// fault rules.  They are used to emulate bad networks.
+package fault
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the kind of a fault.
+type Kind string
+
+const (
+	// ResetBytes means that the tunnel is reset with a TCP RST after the
+	// number of response bytes is forwarded to the client.
+	ResetBytes Kind = "reset-bytes"
+
+	// ResetAfter means that the tunnel is reset with a TCP RST after the
+	// period.
+	ResetAfter Kind = "reset-after"
+
+	// Stall means that the response stalls for a random interval up to the
+	// period before its first bytes are forwarded to the client.
+	Stall Kind = "stall"
+
+	// Truncate means that the response is closed cleanly after the number of
+	// bytes is forwarded to the client.
+	Truncate Kind = "truncate"
+
+	// DialError means that connecting to the backend fails with the error
+	// without an attempt to connect.
+	DialError Kind = "dial-error"
+
+	// Corrupt means that a byte at a random offset within the number of the
+	// first response bytes is inverted.
+	Corrupt Kind = "corrupt"
+)
+
+// DefaultCorruptWindow is the number of the first response bytes one of which
+// is corrupted if Corrupt has no number of bytes.
+const DefaultCorruptWindow = 1024
+
+// Error is the error connecting to the backend fails with.
+type Error string
+
+const (
+	// ErrRefused means that the connection is refused.
+	ErrRefused Error = "refused"
+
+	// ErrReset means that the connection is reset by the peer.
+	ErrReset Error = "reset"
+
+	// ErrUnreachable means that the host is unreachable.
+	ErrUnreachable Error = "unreachable"
+
+	// ErrTimeout means that the connect timeout is exceeded.
+	ErrTimeout Error = "timeout"
+)
+
+// Fault is a fault injected into the tunnel with the probability.
+type Fault struct {
+	// Kind is the kind of the fault.
+	Kind Kind
+
+	// Bytes is the number of bytes for ResetBytes, Truncate and Corrupt.
+	Bytes int64
+
+	// Period is the period for ResetAfter and the maximum stall for Stall.
+	Period time.Duration
+
+	// Error is the error for DialError.
+	Error Error
+
+	// Percent is the probability of the fault in percent, in (0, 100].
+	Percent float64
+}
+
+// String implements the [fmt.Stringer] interface for Fault.
+func (f Fault) String() (s string) {
+	s = string(f.Kind)
+	switch f.Kind {
+	case ResetBytes, Truncate, Corrupt:
+		s += ":" + strconv.FormatInt(f.Bytes, 10)
+	case ResetAfter, Stall:
+		s += ":" + f.Period.String()
+	case DialError:
+		s += ":" + string(f.Error)
+	}
+
+	return s + "@" + strconv.FormatFloat(f.Percent, 'g', -1, 64) + "%"
+}
+
+// Parse parses the fault from its string representation: the kind, followed
+// by a colon and the parameter, optionally followed by "@" and the
+// probability in percent, e.g. "reset-bytes:4096@10" or "stall:2s@50".  The
+// parameter is optional for DialError, which fails with ErrRefused by
+// default, and for Corrupt.  The probability is 100 by default.
+func Parse(s string) (f Fault, err error) {
+	spec, percent, hasPercent := strings.Cut(s, "@")
+	kind, param, hasParam := strings.Cut(spec, ":")
+
+	f.Percent = 100
+	if hasPercent {
+		f.Percent, err = strconv.ParseFloat(strings.TrimSuffix(percent, "%"), 64)
+		if err != nil || !(f.Percent > 0 && f.Percent <= 100) {
+			return Fault{}, fmt.Errorf("fault: bad percent in %q", s)
+		}
+	}
+
+	switch f.Kind = Kind(kind); f.Kind {
+	case ResetBytes, Truncate:
+		if !hasParam {
+			return Fault{}, fmt.Errorf("fault: %q requires number of bytes", kind)
+		}
+
+		f.Bytes, err = parseBytes(param)
+	case Corrupt:
+		f.Bytes = DefaultCorruptWindow
+		if hasParam {
+			f.Bytes, err = parseBytes(param)
+		}
+	case ResetAfter, Stall:
+		if !hasParam {
+			return Fault{}, fmt.Errorf("fault: %q requires period", kind)
+		}
+
+		f.Period, err = time.ParseDuration(param)
+		if err == nil && f.Period <= 0 {
+			err = fmt.Errorf("period %s is not positive", f.Period)
+		}
+	case DialError:
+		f.Error, err = parseError(param)
+	default:
+		return Fault{}, fmt.Errorf("fault: unsupported fault %q", s)
+	}
+
+	if err != nil {
+		return Fault{}, fmt.Errorf("fault: bad parameter in %q: %w", s, err)
+	}
+
+	return f, nil
+}
+
+// ParseList parses the comma-separated list of faults.
+func ParseList(s string) (faults []Fault, err error) {
+	for _, fs := range strings.Split(s, ",") {
+		var f Fault
+		f, err = Parse(strings.TrimSpace(fs))
+		if err != nil {
+			return nil, err
+		}
+
+		faults = append(faults, f)
+	}
+
+	return faults, nil
+}
+
+// parseBytes parses the positive number of bytes.
+func parseBytes(s string) (n int64, err error) {
+	n, err = strconv.ParseInt(s, 10, 64)
+	if err == nil && n <= 0 {
+		err = fmt.Errorf("number of bytes %d is not positive", n)
+	}
+
+	return n, err
+}
+
+// parseError parses the dial error.  An empty string is mapped to
+// ErrRefused.
+func parseError(s string) (e Error, err error) {
+	switch e = Error(s); e {
+	case "":
+		return ErrRefused, nil
+	case ErrRefused, ErrReset, ErrUnreachable, ErrTimeout:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unsupported error %q", s)
+	}
+}
+
+// Roll returns true if the fault happens according to its probability.
+func (f Fault) Roll(r *rand.Rand) (ok bool) {
+	return r.Float64()*100 < f.Percent
+}
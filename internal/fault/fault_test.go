@@ -0,0 +1,171 @@
+package fault_test
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zamibd/gorao/internal/fault"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		want    fault.Fault
+		wantErr bool
+	}{{
+		name: "reset_bytes",
+		in:   "reset-bytes:4096@10",
+		want: fault.Fault{Kind: fault.ResetBytes, Bytes: 4096, Percent: 10},
+	}, {
+		name: "reset_after",
+		in:   "reset-after:5s",
+		want: fault.Fault{Kind: fault.ResetAfter, Period: 5 * time.Second, Percent: 100},
+	}, {
+		name: "stall",
+		in:   "stall:2s@50%",
+		want: fault.Fault{Kind: fault.Stall, Period: 2 * time.Second, Percent: 50},
+	}, {
+		name: "truncate",
+		in:   "truncate:100@0.5",
+		want: fault.Fault{Kind: fault.Truncate, Bytes: 100, Percent: 0.5},
+	}, {
+		name: "corrupt_default",
+		in:   "corrupt",
+		want: fault.Fault{Kind: fault.Corrupt, Bytes: fault.DefaultCorruptWindow, Percent: 100},
+	}, {
+		name: "corrupt_window",
+		in:   "corrupt:16",
+		want: fault.Fault{Kind: fault.Corrupt, Bytes: 16, Percent: 100},
+	}, {
+		name: "dial_error_default",
+		in:   "dial-error@1",
+		want: fault.Fault{Kind: fault.DialError, Error: fault.ErrRefused, Percent: 1},
+	}, {
+		name: "dial_error_timeout",
+		in:   "dial-error:timeout",
+		want: fault.Fault{Kind: fault.DialError, Error: fault.ErrTimeout, Percent: 100},
+	}, {
+		name:    "unknown",
+		in:      "delay:1s",
+		wantErr: true,
+	}, {
+		name:    "empty",
+		in:      "",
+		wantErr: true,
+	}, {
+		name:    "reset_bytes_without_bytes",
+		in:      "reset-bytes",
+		wantErr: true,
+	}, {
+		name:    "truncate_zero_bytes",
+		in:      "truncate:0",
+		wantErr: true,
+	}, {
+		name:    "corrupt_bad_bytes",
+		in:      "corrupt:many",
+		wantErr: true,
+	}, {
+		name:    "stall_without_period",
+		in:      "stall",
+		wantErr: true,
+	}, {
+		name:    "reset_after_negative_period",
+		in:      "reset-after:-1s",
+		wantErr: true,
+	}, {
+		name:    "dial_error_unknown",
+		in:      "dial-error:nxdomain",
+		wantErr: true,
+	}, {
+		name:    "zero_percent",
+		in:      "stall:1s@0",
+		wantErr: true,
+	}, {
+		name:    "too_many_percent",
+		in:      "stall:1s@101",
+		wantErr: true,
+	}, {
+		name:    "nan_percent",
+		in:      "stall:1s@NaN",
+		wantErr: true,
+	}, {
+		name:    "bad_percent",
+		in:      "stall:1s@half",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := fault.Parse(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %v", f)
+				}
+
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if f != tc.want {
+				t.Fatalf("got %+v, want %+v", f, tc.want)
+			}
+
+			// The string representation must be parsed back to the same fault.
+			if got, err := fault.Parse(f.String()); err != nil || got != f {
+				t.Fatalf("round trip of %q: got %+v, %v", f, got, err)
+			}
+		})
+	}
+}
+
+func TestParseList(t *testing.T) {
+	got, err := fault.ParseList("stall:1s@50, truncate:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []fault.Fault{
+		{Kind: fault.Stall, Period: time.Second, Percent: 50},
+		{Kind: fault.Truncate, Bytes: 10, Percent: 100},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"", "stall:1s,", "stall:1s,bad"} {
+		if faults, err := fault.ParseList(s); err == nil {
+			t.Errorf("%q: no error, got %v", s, faults)
+		}
+	}
+}
+
+func TestFault_Roll(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	always := fault.Fault{Kind: fault.Stall, Percent: 100}
+	for range 1000 {
+		if !always.Roll(r) {
+			t.Fatal("fault with 100% probability doesn't happen")
+		}
+	}
+
+	const n = 10000
+	sometimes := fault.Fault{Kind: fault.Stall, Percent: 10}
+
+	var happened int
+	for range n {
+		if sometimes.Roll(r) {
+			happened++
+		}
+	}
+
+	// The seed is fixed, so the result is deterministic, but allow for the
+	// generator to change between Go versions.
+	if happened < n/20 || happened > n/5 {
+		t.Fatalf("fault with 10%% probability happened %d times out of %d", happened, n)
+	}
+}
@@ -1,7 +1,11 @@
 // Package filter provides helpers for applying all kinds of rules.
 package filter
 
-import "github.com/IGLOU-EU/go-wildcard"
+import (
+	"net/netip"
+
+	"github.com/IGLOU-EU/go-wildcard"
+)
 
 // MatchWildcards checks if the string str matches any of the specified
 // wildcards.
@@ -14,3 +18,40 @@ func MatchWildcards(str string, wildcards []string) (ok bool) {
 
 	return false
 }
+
+// ClientFilter is an access control list of client networks.
+type ClientFilter struct {
+	// Allow is the list of networks the clients are allowed from.  If empty,
+	// all clients that are not denied are allowed.
+	Allow []netip.Prefix
+
+	// Deny is the list of networks the clients are denied from.  Has higher
+	// priority than Allow.
+	Deny []netip.Prefix
+}
+
+// Allowed returns true if the client with the address addr is allowed.  A nil
+// *ClientFilter allows every client.
+func (f *ClientFilter) Allowed(addr netip.Addr) (ok bool) {
+	if f == nil {
+		return true
+	}
+
+	addr = addr.Unmap()
+	if matchPrefixes(addr, f.Deny) {
+		return false
+	}
+
+	return len(f.Allow) == 0 || matchPrefixes(addr, f.Allow)
+}
+
+// matchPrefixes checks if addr belongs to any of the specified networks.
+func matchPrefixes(addr netip.Addr, prefixes []netip.Prefix) (ok bool) {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
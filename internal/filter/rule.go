@@ -0,0 +1,250 @@
+package filter
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/IGLOU-EU/go-wildcard"
+)
+
+// Target is a connection the rules are matched against.
+type Target struct {
+	// Host is the hostname the connection is made to.
+	Host string
+
+	// Listener is the name of the listener that has accepted the connection.
+	Listener string
+
+	// Dst is the original destination of the connection.  It is invalid if
+	// the connection has not been redirected to the proxy transparently.
+	Dst netip.AddrPort
+
+	// ECH is true if the TLS ClientHello of the connection is encrypted.
+	ECH bool
+}
+
+// Rule is a connection rule.  Its string representation is a hostname
+// wildcard optionally followed by semicolon-separated qualifiers that narrow
+// it down, for instance "*.example.org;listener=imaps".  The supported
+// qualifiers are:
+//
+//   - listener=<wildcard> matches the name of the listener.
+//   - dst=<cidr> matches the original destination address of a transparently
+//     redirected connection.
+//   - dst_port=<port> matches the original destination port of a
+//     transparently redirected connection.
+//   - ech=<true|false> matches the connections with or without an encrypted
+//     TLS ClientHello.  Chrome and Firefox send a GREASE ECH extension that
+//     is indistinguishable from the real one even without an ECH
+//     configuration, so ech=true matches most of their connections.
+type Rule struct {
+	// raw is the original string representation of the rule.
+	raw string
+
+	// host is the hostname wildcard.
+	host string
+
+	// listener is the listener name wildcard, it is empty if the rule does
+	// not have this qualifier.
+	listener string
+
+	// dst is the original destination network, it is invalid if the rule
+	// does not have this qualifier.
+	dst netip.Prefix
+
+	// dstPort is the original destination port, it is zero if the rule does
+	// not have this qualifier.
+	dstPort uint16
+
+	// ech is the required ECH state, it is nil if the rule does not have this
+	// qualifier.
+	ech *bool
+}
+
+// ParseRule parses the rule from its string representation.
+func ParseRule(s string) (r *Rule, err error) {
+	parts := strings.Split(s, ";")
+
+	r = &Rule{
+		raw:  s,
+		host: strings.TrimSpace(parts[0]),
+	}
+
+	if r.host == "" {
+		r.host = "*"
+	}
+
+	for _, q := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(q), "=")
+		if val == "" {
+			return nil, fmt.Errorf("filter: rule %q: qualifier %q has no value", s, key)
+		}
+
+		switch key {
+		case "listener":
+			r.listener = val
+		case "dst":
+			r.dst, err = parsePrefix(val)
+		case "dst_port":
+			var port uint64
+			port, err = strconv.ParseUint(val, 10, 16)
+			if err == nil && port == 0 {
+				err = errors.New("port is zero")
+			}
+
+			r.dstPort = uint16(port)
+		case "ech":
+			var ech bool
+			ech, err = strconv.ParseBool(val)
+			r.ech = &ech
+		default:
+			return nil, fmt.Errorf("filter: rule %q: unknown qualifier %q", s, key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("filter: rule %q: bad %s: %w", s, key, err)
+		}
+	}
+
+	return r, nil
+}
+
+// ParseRules parses the list of rules.
+func ParseRules(list []string) (rules []*Rule, err error) {
+	for _, s := range list {
+		var r *Rule
+		r, err = ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// String implements the [fmt.Stringer] interface for *Rule.
+func (r *Rule) String() (s string) {
+	return r.raw
+}
+
+// Match returns true if the rule matches the target.
+func (r *Rule) Match(t *Target) (ok bool) {
+	if !wildcard.MatchSimple(r.host, t.Host) {
+		return false
+	}
+
+	if r.listener != "" && !wildcard.MatchSimple(r.listener, t.Listener) {
+		return false
+	}
+
+	if r.dst.IsValid() && !(t.Dst.IsValid() && r.dst.Contains(t.Dst.Addr().Unmap())) {
+		return false
+	}
+
+	if r.dstPort != 0 && !(t.Dst.IsValid() && r.dstPort == t.Dst.Port()) {
+		return false
+	}
+
+	if r.ech != nil && *r.ech != t.ECH {
+		return false
+	}
+
+	return true
+}
+
+// parsePrefix parses a CIDR.  A plain IP address is treated as a
+// single-address network.
+func parsePrefix(s string) (p netip.Prefix, err error) {
+	if strings.Contains(s, "/") {
+		p, err = netip.ParsePrefix(s)
+
+		return p.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return p, err
+	}
+
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// MatchRules returns the first rule from the list that matches the target.
+func MatchRules(t *Target, rules []*Rule) (r *Rule, ok bool) {
+	for _, r = range rules {
+		if r.Match(t) {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// RuleMap maps rules to values.
+type RuleMap[T any] struct {
+	rules  []*Rule
+	values []T
+}
+
+// NewRuleMap parses the keys of m as rules and creates a *RuleMap.
+func NewRuleMap[T any](m map[string]T) (rm *RuleMap[T], err error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	// The longest rule is considered the most specific one, ties are resolved
+	// by comparing rules lexicographically so that the result does not depend
+	// on the map iteration order.
+	slices.SortFunc(keys, func(a, b string) (res int) {
+		return cmp.Or(cmp.Compare(len(b), len(a)), strings.Compare(a, b))
+	})
+
+	rm = &RuleMap[T]{}
+	for _, k := range keys {
+		var r *Rule
+		r, err = ParseRule(k)
+		if err != nil {
+			return nil, err
+		}
+
+		rm.rules = append(rm.rules, r)
+		rm.values = append(rm.values, m[k])
+	}
+
+	return rm, nil
+}
+
+// Match returns the value of the most specific rule that matches the target.
+// A nil *RuleMap matches nothing.
+func (rm *RuleMap[T]) Match(t *Target) (v T, r *Rule, ok bool) {
+	if rm == nil {
+		return v, nil, false
+	}
+
+	for i, r := range rm.rules {
+		if r.Match(t) {
+			return rm.values[i], r, true
+		}
+	}
+
+	return v, nil, false
+}
+
+// Len returns the number of rules in the map.
+func (rm *RuleMap[T]) Len() (n int) {
+	if rm == nil {
+		return 0
+	}
+
+	return len(rm.rules)
+}
@@ -0,0 +1,263 @@
+package filter_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+func TestParseRule(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		wantErr bool
+	}{{
+		name: "host",
+		in:   "*.example.org",
+	}, {
+		name: "qualifiers_only",
+		in:   ";listener=imaps",
+	}, {
+		name: "all_qualifiers",
+		in:   "*.example.org; listener=tls*; dst=192.0.2.0/24; dst_port=443; ech=true",
+	}, {
+		name: "dst_address",
+		in:   "*;dst=2001:db8::1",
+	}, {
+		name:    "unknown_qualifier",
+		in:      "*.example.org;port=443",
+		wantErr: true,
+	}, {
+		name:    "qualifier_without_value",
+		in:      "*.example.org;listener",
+		wantErr: true,
+	}, {
+		name:    "empty_value",
+		in:      "*.example.org;listener=",
+		wantErr: true,
+	}, {
+		name:    "bad_dst",
+		in:      "*;dst=192.0.2.0/33",
+		wantErr: true,
+	}, {
+		name:    "bad_dst_address",
+		in:      "*;dst=example.org",
+		wantErr: true,
+	}, {
+		name:    "bad_dst_port",
+		in:      "*;dst_port=https",
+		wantErr: true,
+	}, {
+		name:    "dst_port_too_big",
+		in:      "*;dst_port=65536",
+		wantErr: true,
+	}, {
+		name:    "zero_dst_port",
+		in:      "*;dst_port=0",
+		wantErr: true,
+	}, {
+		name:    "bad_ech",
+		in:      "*;ech=maybe",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := filter.ParseRule(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %v", r)
+				}
+
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := r.String(); got != tc.in {
+				t.Fatalf("got %q, want %q", got, tc.in)
+			}
+		})
+	}
+}
+
+func TestRule_Match(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.10:443")
+
+	testCases := []struct {
+		target filter.Target
+		name   string
+		rule   string
+		want   bool
+	}{{
+		target: filter.Target{Host: "www.example.org"},
+		name:   "host",
+		rule:   "*.example.org",
+		want:   true,
+	}, {
+		target: filter.Target{Host: "example.net"},
+		name:   "other_host",
+		rule:   "*.example.org",
+		want:   false,
+	}, {
+		target: filter.Target{Host: "example.org"},
+		name:   "empty_host",
+		rule:   ";ech=false",
+		want:   true,
+	}, {
+		target: filter.Target{Host: "example.org", Listener: "tls-alt"},
+		name:   "listener",
+		rule:   "example.org;listener=tls*",
+		want:   true,
+	}, {
+		target: filter.Target{Host: "example.org", Listener: "http"},
+		name:   "other_listener",
+		rule:   "example.org;listener=tls*",
+		want:   false,
+	}, {
+		target: filter.Target{Host: "example.org", Dst: dst},
+		name:   "dst_cidr",
+		rule:   "*;dst=192.0.2.0/24",
+		want:   true,
+	}, {
+		target: filter.Target{Host: "example.org", Dst: dst},
+		name:   "dst_cidr_not_masked",
+		rule:   "*;dst=192.0.2.1/24",
+		want:   true,
+	}, {
+		target: filter.Target{Host: "example.org", Dst: dst},
+		name:   "dst_other_cidr",
+		rule:   "*;dst=198.51.100.0/24",
+		want:   false,
+	}, {
+		target: filter.Target{Host: "example.org", Dst: dst},
+		name:   "dst_address",
+		rule:   "*;dst=192.0.2.10",
+		want:   true,
+	}, {
+		target: filter.Target{
+			Host: "example.org",
+			Dst:  netip.AddrPortFrom(netip.MustParseAddr("::ffff:192.0.2.10"), 443),
+		},
+		name: "dst_mapped_address",
+		rule: "*;dst=192.0.2.0/24",
+		want: true,
+	}, {
+		target: filter.Target{Host: "example.org"},
+		name:   "dst_not_transparent",
+		rule:   "*;dst=0.0.0.0/0",
+		want:   false,
+	}, {
+		target: filter.Target{Host: "example.org", Dst: dst},
+		name:   "dst_port",
+		rule:   "*;dst_port=443",
+		want:   true,
+	}, {
+		target: filter.Target{Host: "example.org", Dst: dst},
+		name:   "other_dst_port",
+		rule:   "*;dst_port=8443",
+		want:   false,
+	}, {
+		target: filter.Target{Host: "example.org"},
+		name:   "dst_port_not_transparent",
+		rule:   "*;dst_port=443",
+		want:   false,
+	}, {
+		target: filter.Target{Host: "example.org", ECH: true},
+		name:   "ech",
+		rule:   "*;ech=true",
+		want:   true,
+	}, {
+		target: filter.Target{Host: "example.org"},
+		name:   "no_ech",
+		rule:   "*;ech=true",
+		want:   false,
+	}, {
+		target: filter.Target{Host: "example.org", Listener: "tls", Dst: dst, ECH: true},
+		name:   "all_qualifiers",
+		rule:   "*.org;listener=tls;dst=192.0.2.0/24;dst_port=443;ech=true",
+		want:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := filter.ParseRule(tc.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := r.Match(&tc.target); got != tc.want {
+				t.Fatalf("rule %q: got %t, want %t", tc.rule, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleMap_Match(t *testing.T) {
+	rm, err := filter.NewRuleMap(map[string]string{
+		"*.example.org":                    "wildcard",
+		"www.example.org":                  "host",
+		"www.example.org;listener=imaps":   "qualified",
+		"*.example.org;dst=192.0.2.0/24":   "dst",
+		"*.example.org;dst=192.0.2.128/25": "narrow_dst",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		target   filter.Target
+		name     string
+		want     string
+		wantRule string
+	}{{
+		target:   filter.Target{Host: "www.example.org", Listener: "imaps"},
+		name:     "qualified_wins",
+		want:     "qualified",
+		wantRule: "www.example.org;listener=imaps",
+	}, {
+		target:   filter.Target{Host: "www.example.org", Listener: "tls"},
+		name:     "unqualified_fallback",
+		want:     "host",
+		wantRule: "www.example.org",
+	}, {
+		// The longest rule wins even if its host wildcard is less specific.
+		target:   filter.Target{Host: "www.example.org", Dst: netip.MustParseAddrPort("192.0.2.1:443")},
+		name:     "longest_wins",
+		want:     "dst",
+		wantRule: "*.example.org;dst=192.0.2.0/24",
+	}, {
+		target:   filter.Target{Host: "mail.example.org", Dst: netip.MustParseAddrPort("192.0.2.200:443")},
+		name:     "narrow_dst",
+		want:     "narrow_dst",
+		wantRule: "*.example.org;dst=192.0.2.128/25",
+	}, {
+		target:   filter.Target{Host: "mail.example.org"},
+		name:     "wildcard",
+		want:     "wildcard",
+		wantRule: "*.example.org",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, r, ok := rm.Match(&tc.target)
+			if !ok {
+				t.Fatal("no match")
+			}
+
+			if v != tc.want || r.String() != tc.wantRule {
+				t.Fatalf("got %q by %q, want %q by %q", v, r, tc.want, tc.wantRule)
+			}
+		})
+	}
+
+	if _, _, ok := rm.Match(&filter.Target{Host: "example.net"}); ok {
+		t.Fatal("unexpected match of example.net")
+	}
+
+	var nilMap *filter.RuleMap[string]
+	if _, _, ok := nilMap.Match(&filter.Target{Host: "example.org"}); ok {
+		t.Fatal("nil map matches")
+	}
+}
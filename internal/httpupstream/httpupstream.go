@@ -164,7 +164,7 @@ func (d *HTTPProxyDialer) DialContext(
 	if resp.StatusCode != http.StatusOK {
 		log.OnCloserError(conn, log.DEBUG)
 
-		return nil, fmt.Errorf("httpupstream: bad status code from proxy: %d", resp.StatusCode)
+		return nil, &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	stopGuard()
@@ -176,6 +176,21 @@ func (d *HTTPProxyDialer) DialContext(
 	return conn, nil
 }
 
+// StatusError is returned when the proxy responds to CONNECT with a status
+// other than 200 OK.
+type StatusError struct {
+	// StatusCode is the status code of the proxy response.
+	StatusCode int
+}
+
+// type check
+var _ error = (*StatusError)(nil)
+
+// Error implements the error interface for *StatusError.
+func (e *StatusError) Error() (s string) {
+	return fmt.Sprintf("httpupstream: bad status code from proxy: %d", e.StatusCode)
+}
+
 var (
 	responseTerminator = []byte("\r\n\r\n")
 )
@@ -0,0 +1,404 @@
+// Package proxypool implements a pool of upstream proxies with health checks,
+// failover and load balancing.
+package proxypool
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/proxy"
+)
+
+// Strategy defines how the pool chooses a proxy for a new connection.
+type Strategy string
+
+const (
+	// RoundRobin spreads the connections evenly between the healthy proxies.
+	RoundRobin Strategy = "round-robin"
+
+	// LeastConn chooses the healthy proxy with the least number of active
+	// connections.
+	LeastConn Strategy = "least-conn"
+
+	// Priority chooses the first healthy proxy in the order they were
+	// specified, the rest are only used for failover.
+	Priority Strategy = "priority"
+)
+
+// ParseStrategy parses the strategy from its string representation.  An empty
+// string is mapped to RoundRobin.
+func ParseStrategy(s string) (st Strategy, err error) {
+	switch st = Strategy(s); st {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastConn, Priority:
+		return st, nil
+	default:
+		return "", fmt.Errorf("proxypool: unsupported strategy %q", s)
+	}
+}
+
+const (
+	// defaultCheckTimeout is the timeout of a single health check.
+	defaultCheckTimeout = 5 * time.Second
+
+	// defaultMaxFails is the default number of consecutive failures after
+	// which a proxy is considered down.
+	defaultMaxFails = 3
+)
+
+// Member is a single proxy of the pool.
+type Member struct {
+	// Dialer is the dialer that connects through the proxy.
+	Dialer proxy.Dialer
+
+	// Name is the name of the proxy that is used in the logs.  It must not
+	// contain credentials.
+	Name string
+
+	// Addr is the address of the proxy itself, it is used for TCP health
+	// checks.
+	Addr string
+
+	// active is the number of active connections through the proxy.
+	active atomic.Int64
+
+	// fails is the number of consecutive failures.
+	fails atomic.Int64
+
+	// down is true if the proxy is considered unhealthy.
+	down atomic.Bool
+}
+
+// Config is the pool configuration.
+type Config struct {
+	// Dialer is used to connect to the proxies for TCP health checks.
+	Dialer proxy.Dialer
+
+	// Name is the name of the pool that is used in the logs.
+	Name string
+
+	// Strategy defines how the proxy is chosen for a new connection.
+	Strategy Strategy
+
+	// Probe is the address that is connected to through the proxies for
+	// health checks.  If empty, health checks just connect to the proxies.
+	Probe string
+
+	// Members is the list of the proxies.  The order matters for the Priority
+	// strategy.
+	Members []*Member
+
+	// CheckInterval is the interval between active health checks.  If zero,
+	// only passive failure detection is used.
+	CheckInterval time.Duration
+
+	// MaxFails is the number of consecutive failures after which a proxy is
+	// considered down.  If zero, defaultMaxFails is used.
+	MaxFails int
+}
+
+// TargetError is returned by the member dialers when the proxy has accepted
+// the request but has failed to connect to the target, e.g. the target has
+// refused the connection.  Such errors aren't failures of the proxy.
+type TargetError struct {
+	// Err is the error reported by the proxy.
+	Err error
+}
+
+// type check
+var _ error = (*TargetError)(nil)
+
+// Error implements the error interface for *TargetError.
+func (e *TargetError) Error() (s string) {
+	return e.Err.Error()
+}
+
+// Unwrap implements the errors.Unwrap interface for *TargetError.
+func (e *TargetError) Unwrap() (err error) {
+	return e.Err
+}
+
+// Pool is a proxy.Dialer that distributes connections between several
+// proxies.
+type Pool struct {
+	dialer        proxy.Dialer
+	name          string
+	strategy      Strategy
+	probe         string
+	members       []*Member
+	checkInterval time.Duration
+	maxFails      int64
+
+	// next is the round-robin counter.
+	next atomic.Uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// closeOnce makes the repeated calls of Close no-op.
+	closeOnce sync.Once
+}
+
+// type check
+var (
+	_ proxy.Dialer        = (*Pool)(nil)
+	_ proxy.ContextDialer = (*Pool)(nil)
+)
+
+// New creates a new instance of *Pool.
+func New(cfg *Config) (p *Pool) {
+	maxFails := int64(cfg.MaxFails)
+	if maxFails <= 0 {
+		maxFails = defaultMaxFails
+	}
+
+	return &Pool{
+		dialer:        cfg.Dialer,
+		name:          cfg.Name,
+		strategy:      cfg.Strategy,
+		probe:         cfg.Probe,
+		members:       cfg.Members,
+		checkInterval: cfg.CheckInterval,
+		maxFails:      maxFails,
+		done:          make(chan struct{}),
+	}
+}
+
+// Start starts the active health checks if they're enabled.
+func (p *Pool) Start() {
+	if p.checkInterval <= 0 {
+		return
+	}
+
+	log.Info(
+		"proxypool: %s: checking %d proxies every %v",
+		p.name,
+		len(p.members),
+		p.checkInterval,
+	)
+
+	p.wg.Add(1)
+	go p.checkLoop()
+}
+
+// Close stops the active health checks.  Only the first call has effect.
+func (p *Pool) Close() (err error) {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+	})
+
+	return nil
+}
+
+// Dial implements the proxy.Dialer interface for *Pool.
+func (p *Pool) Dial(network, addr string) (conn net.Conn, err error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements the proxy.ContextDialer interface for *Pool.  It
+// tries the proxies one by one in the order defined by the strategy until one
+// of them succeeds or ctx is done.  If a proxy reports that the target has
+// failed, *TargetError is returned right away since the other proxies would
+// fail the same way.
+func (p *Pool) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	var errs []error
+	for _, m := range p.candidates() {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+
+			break
+		}
+
+		conn, err = dialContext(ctx, m.Dialer, network, addr)
+
+		var tErr *TargetError
+		switch {
+		case errors.As(err, &tErr):
+			p.succeed(m)
+
+			return nil, fmt.Errorf("proxypool: %s: %s: %w", p.name, m.Name, err)
+		case err != nil:
+			// The deadline of ctx may be shorter than the proxy needs, so
+			// that's not the fault of the proxy.
+			if ctx.Err() == nil {
+				p.fail(m, err)
+			}
+
+			errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+
+			continue
+		}
+
+		p.succeed(m)
+		m.active.Add(1)
+
+		log.Debug("proxypool: %s: connected to %s via %s", p.name, addr, m.Name)
+
+		return &memberConn{Conn: conn, member: m}, nil
+	}
+
+	return nil, fmt.Errorf("proxypool: %s: all proxies failed: %w", p.name, errors.Join(errs...))
+}
+
+// candidates returns the members in the order they should be tried.  The
+// healthy ones come first, the unhealthy ones are tried as the last resort.
+func (p *Pool) candidates() (res []*Member) {
+	var healthy, unhealthy []*Member
+	for _, m := range p.members {
+		if m.down.Load() {
+			unhealthy = append(unhealthy, m)
+		} else {
+			healthy = append(healthy, m)
+		}
+	}
+
+	switch p.strategy {
+	case RoundRobin:
+		if n := len(healthy); n > 0 {
+			start := int(p.next.Add(1) % uint64(n))
+			healthy = slices.Concat(healthy[start:], healthy[:start])
+		}
+	case LeastConn:
+		slices.SortStableFunc(healthy, func(a, b *Member) (res int) {
+			return cmp.Compare(a.active.Load(), b.active.Load())
+		})
+	default:
+		// Priority, keep the configured order.
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// fail records a failure of the member and marks it down once there are too
+// many consecutive failures.
+func (p *Pool) fail(m *Member, err error) {
+	if m.fails.Add(1) >= p.maxFails && m.down.CompareAndSwap(false, true) {
+		log.Info("proxypool: %s: proxy %s is down: %v", p.name, m.Name, err)
+	}
+}
+
+// succeed records a success of the member and marks it up.
+func (p *Pool) succeed(m *Member) {
+	m.fails.Store(0)
+	if m.down.CompareAndSwap(true, false) {
+		log.Info("proxypool: %s: proxy %s is up", p.name, m.Name)
+	}
+}
+
+// checkLoop runs the active health checks until the pool is closed.
+func (p *Pool) checkLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			for _, m := range p.members {
+				p.check(m)
+			}
+		}
+	}
+}
+
+// check runs a single health check of the member.
+func (p *Pool) check(m *Member) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCheckTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if p.probe == "" {
+		conn, err = dialContext(ctx, p.dialer, "tcp", m.Addr)
+	} else {
+		conn, err = dialContext(ctx, m.Dialer, "tcp", p.probe)
+	}
+
+	if err != nil {
+		log.Debug("proxypool: %s: health check of %s failed: %v", p.name, m.Name, err)
+		p.fail(m, err)
+
+		return
+	}
+
+	log.OnCloserError(conn, log.DEBUG)
+	p.succeed(m)
+}
+
+// dialContext dials addr using d and respects the context deadline if d
+// supports it.
+func dialContext(
+	ctx context.Context,
+	d proxy.Dialer,
+	network string,
+	addr string,
+) (conn net.Conn, err error) {
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+
+	return d.Dial(network, addr)
+}
+
+// memberConn is a net.Conn that decrements the number of active connections
+// of the member when it is closed.
+type memberConn struct {
+	net.Conn
+
+	member *Member
+	once   sync.Once
+}
+
+// Close implements the net.Conn interface for *memberConn.
+func (c *memberConn) Close() (err error) {
+	c.once.Do(func() {
+		c.member.active.Add(-1)
+	})
+
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the underlying connection if it is
+// supported.
+func (c *memberConn) CloseWrite() (err error) {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// SetLinger sets the linger of the underlying connection if it is supported.
+// The tunnels are reset through it, so it must not be hidden by memberConn.
+func (c *memberConn) SetLinger(sec int) (err error) {
+	if l, ok := c.Conn.(interface{ SetLinger(sec int) error }); ok {
+		return l.SetLinger(sec)
+	}
+
+	return nil
+}
+
+// SetKeepAliveConfig configures the TCP keepalive of the underlying connection
+// if it is supported.
+func (c *memberConn) SetKeepAliveConfig(cfg net.KeepAliveConfig) (err error) {
+	if ka, ok := c.Conn.(interface {
+		SetKeepAliveConfig(cfg net.KeepAliveConfig) error
+	}); ok {
+		return ka.SetKeepAliveConfig(cfg)
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zamibd/gorao/internal/proxypool"
+)
+
+// testDialer is a proxy.Dialer that records its name in calls and fails with
+// err if it's not nil.
+type testDialer struct {
+	calls *[]string
+	err   error
+	name  string
+}
+
+// Dial implements the proxy.Dialer interface for *testDialer.
+func (d *testDialer) Dial(_, _ string) (conn net.Conn, err error) {
+	*d.calls = append(*d.calls, d.name)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+
+	return conn, nil
+}
+
+// errProxy is the error of the proxies that are down.
+var errProxy = errors.New("proxy is down")
+
+// newTestPool returns a pool of the members with the names, its dialers by
+// name and the calls the dialers record.
+func newTestPool(
+	strategy proxypool.Strategy,
+	maxFails int,
+	names ...string,
+) (p *proxypool.Pool, dialers map[string]*testDialer, calls *[]string) {
+	calls = &[]string{}
+	dialers = map[string]*testDialer{}
+
+	cfg := &proxypool.Config{
+		Name:     "test",
+		Strategy: strategy,
+		MaxFails: maxFails,
+	}
+	for _, name := range names {
+		d := &testDialer{calls: calls, name: name}
+		dialers[name] = d
+		cfg.Members = append(cfg.Members, &proxypool.Member{Dialer: d, Name: name})
+	}
+
+	return proxypool.New(cfg), dialers, calls
+}
+
+// dial dials through p and returns the names of the members tried in order.
+// The connection, if any, is left open.
+func dial(t *testing.T, p *proxypool.Pool, calls *[]string) (tried []string, err error) {
+	t.Helper()
+
+	*calls = (*calls)[:0]
+	_, err = p.DialContext(context.Background(), "tcp", "example.org:443")
+
+	return slices.Clone(*calls), err
+}
+
+func TestPool_candidates(t *testing.T) {
+	testCases := []struct {
+		name     string
+		strategy proxypool.Strategy
+		// succeed is the member that accepts the first connection, the rest
+		// fail.  The connection stays open.
+		succeed string
+		want    [][]string
+	}{{
+		name:     "round_robin",
+		strategy: proxypool.RoundRobin,
+		want: [][]string{
+			{"b", "c", "a"},
+			{"c", "a", "b"},
+			{"a", "b", "c"},
+		},
+	}, {
+		name:     "priority",
+		strategy: proxypool.Priority,
+		want: [][]string{
+			{"a", "b", "c"},
+			{"a", "b", "c"},
+		},
+	}, {
+		name:     "least_conn",
+		strategy: proxypool.LeastConn,
+		succeed:  "a",
+		want: [][]string{
+			{"a"},
+			{"b", "c", "a"},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Don't let the failing members go down.
+			p, dialers, calls := newTestPool(tc.strategy, 100, "a", "b", "c")
+			for name, d := range dialers {
+				if name != tc.succeed {
+					d.err = errProxy
+				}
+			}
+
+			for i, want := range tc.want {
+				got, _ := dial(t, p, calls)
+				if !slices.Equal(got, want) {
+					t.Fatalf("dial %d: got %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPool_ejection(t *testing.T) {
+	p, dialers, calls := newTestPool(proxypool.Priority, 2, "a", "b")
+
+	testCases := []struct {
+		name    string
+		failing []string
+		want    []string
+		wantErr bool
+	}{{
+		name: "healthy",
+		want: []string{"a"},
+	}, {
+		name:    "first_failure",
+		failing: []string{"a"},
+		want:    []string{"a", "b"},
+	}, {
+		name:    "ejected",
+		failing: []string{"a"},
+		want:    []string{"a", "b"},
+	}, {
+		name: "ejected_is_last",
+		want: []string{"b"},
+	}, {
+		name:    "ejected_as_last_resort",
+		failing: []string{"b"},
+		want:    []string{"b", "a"},
+	}, {
+		name: "recovered",
+		want: []string{"a"},
+	}, {
+		name:    "all_failed",
+		failing: []string{"a", "b"},
+		want:    []string{"a", "b"},
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, d := range dialers {
+				d.err = nil
+				if slices.Contains(tc.failing, name) {
+					d.err = errProxy
+				}
+			}
+
+			got, err := dial(t, p, calls)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			} else if !slices.Equal(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPool_targetError(t *testing.T) {
+	p, dialers, calls := newTestPool(proxypool.Priority, 2, "a", "b")
+
+	targetErr := &proxypool.TargetError{Err: errors.New("connection refused")}
+	dialers["a"].err = targetErr
+
+	// The target errors don't count as failures of the proxy, so it's never
+	// ejected.
+	for i := range 5 {
+		got, err := dial(t, p, calls)
+		if !errors.Is(err, targetErr) {
+			t.Fatalf("dial %d: got error %v, want %v", i, err, targetErr)
+		} else if !slices.Equal(got, []string{"a"}) {
+			t.Fatalf("dial %d: got %v, want [a]", i, got)
+		}
+	}
+}
+
+func TestPool_connOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	p := proxypool.New(&proxypool.Config{
+		Name:    "test",
+		Members: []*proxypool.Member{{Dialer: &net.Dialer{}, Name: "direct"}},
+	})
+
+	conn, err := p.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	// The tunnels are reset and kept alive through these methods, so the pool
+	// must not hide them.
+	ln, ok := conn.(interface{ SetLinger(sec int) error })
+	if !ok {
+		t.Fatalf("%T doesn't implement SetLinger", conn)
+	} else if err = ln.SetLinger(0); err != nil {
+		t.Fatalf("setting linger: %v", err)
+	}
+
+	ka, ok := conn.(interface {
+		SetKeepAliveConfig(cfg net.KeepAliveConfig) error
+	})
+	if !ok {
+		t.Fatalf("%T doesn't implement SetKeepAliveConfig", conn)
+	} else if err = ka.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true}); err != nil {
+		t.Fatalf("setting keepalive: %v", err)
+	}
+}
+
+func TestPool_Close(t *testing.T) {
+	p := proxypool.New(&proxypool.Config{
+		Name:          "test",
+		CheckInterval: time.Hour,
+	})
+	p.Start()
+
+	for i := range 2 {
+		if err := p.Close(); err != nil {
+			t.Fatalf("close %d: %v", i, err)
+		}
+	}
+}
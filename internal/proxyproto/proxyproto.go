@@ -0,0 +1,338 @@
+// Package proxyproto implements reading and writing of PROXY protocol v1 and
+// v2 headers.  See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+// for the protocol specification.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Version is the PROXY protocol version.
+type Version byte
+
+const (
+	// V1 is the human-readable version of the protocol.
+	V1 Version = 1
+
+	// V2 is the binary version of the protocol.
+	V2 Version = 2
+)
+
+// String implements the [fmt.Stringer] interface for Version.
+func (v Version) String() (s string) {
+	return "v" + strconv.Itoa(int(v))
+}
+
+// ParseVersion parses the protocol version from its string representation,
+// i.e. "v1" or "v2".
+func ParseVersion(s string) (v Version, err error) {
+	switch strings.ToLower(s) {
+	case "v1", "1":
+		return V1, nil
+	case "v2", "2":
+		return V2, nil
+	default:
+		return 0, fmt.Errorf("proxyproto: unsupported version %q", s)
+	}
+}
+
+const (
+	// v1Prefix is the prefix every v1 header starts with.
+	v1Prefix = "PROXY "
+
+	// v1MaxLen is the maximum length of a v1 header including CRLF.
+	v1MaxLen = 107
+
+	// v2HeaderLen is the length of the fixed part of a v2 header.
+	v2HeaderLen = 16
+
+	// v2MaxLen is the maximum length of the variable part of a v2 header that
+	// is accepted.  The protocol allows up to 64K, but real-world headers are
+	// much shorter.
+	v2MaxLen = 4096
+)
+
+// v2Signature is the signature every v2 header starts with.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoHeader is returned by Read when the stream does not start with a PROXY
+// protocol header.
+var ErrNoHeader = errors.New("proxyproto: no header")
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// Src is the address of the client that has initiated the connection.
+	Src netip.AddrPort
+
+	// Dst is the address the client has connected to.
+	Dst netip.AddrPort
+
+	// Version is the version of the protocol the header is encoded with.
+	Version Version
+
+	// Local is true if the header does not carry the connection addresses,
+	// i.e. it is a v2 LOCAL command or a v1 UNKNOWN header.  Src and Dst must
+	// be ignored in this case.
+	Local bool
+}
+
+// Read reads a PROXY protocol header from r.  If r does not start with a
+// header, it returns ErrNoHeader and does not consume any data.
+func Read(r *bufio.Reader) (h *Header, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: reading header: %w", err)
+	}
+
+	switch b[0] {
+	case v1Prefix[0]:
+		b, err = r.Peek(len(v1Prefix))
+		if err == nil && string(b) == v1Prefix {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		b, err = r.Peek(len(v2Signature))
+		if err == nil && bytes.Equal(b, v2Signature) {
+			return readV2(r)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: reading header: %w", err)
+	}
+
+	return nil, ErrNoHeader
+}
+
+// readV1 reads a v1 header from r.
+func readV1(r *bufio.Reader) (h *Header, err error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		var c byte
+		c, err = r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: reading v1 header: %w", err)
+		}
+
+		line = append(line, c)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			return parseV1(string(line[:len(line)-2]))
+		}
+	}
+
+	return nil, errors.New("proxyproto: v1 header is too long")
+}
+
+// parseV1 parses a v1 header line without the trailing CRLF.
+func parseV1(line string) (h *Header, err error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: V1, Local: true}, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header %q", line)
+	}
+
+	h = &Header{Version: V1}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: bad v1 source: %w", err)
+	}
+
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: bad v1 destination: %w", err)
+	}
+
+	switch fields[1] {
+	case "TCP4":
+		if !src.Addr().Is4() || !dst.Addr().Is4() {
+			return nil, fmt.Errorf("proxyproto: non-ipv4 address in %q", line)
+		}
+	case "TCP6":
+		if !src.Addr().Is6() || !dst.Addr().Is6() {
+			return nil, fmt.Errorf("proxyproto: non-ipv6 address in %q", line)
+		}
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported v1 protocol %q", fields[1])
+	}
+
+	h.Src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	h.Dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+
+	return h, nil
+}
+
+// parseV1Addr parses an address and a port from a v1 header.
+func parseV1Addr(addr, port string) (addrPort netip.AddrPort, err error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+// readV2 reads a v2 header from r.
+func readV2(r *bufio.Reader) (h *Header, err error) {
+	hdr := make([]byte, v2HeaderLen)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("proxyproto: reading v2 header: %w", err)
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 version %d", verCmd>>4)
+	}
+
+	if length > v2MaxLen {
+		return nil, fmt.Errorf("proxyproto: v2 header is too long: %d", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxyproto: reading v2 addresses: %w", err)
+	}
+
+	h = &Header{Version: V2}
+
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL command, the addresses must be ignored.
+		h.Local = true
+
+		return h, nil
+	case 0x1:
+		// PROXY command, go on.
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported v2 command %d", verCmd&0x0f)
+	}
+
+	switch fam >> 4 {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, errors.New("proxyproto: v2 ipv4 addresses are too short")
+		}
+
+		h.Src = netip.AddrPortFrom(
+			netip.AddrFrom4([4]byte(payload[0:4])),
+			binary.BigEndian.Uint16(payload[8:10]),
+		)
+		h.Dst = netip.AddrPortFrom(
+			netip.AddrFrom4([4]byte(payload[4:8])),
+			binary.BigEndian.Uint16(payload[10:12]),
+		)
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, errors.New("proxyproto: v2 ipv6 addresses are too short")
+		}
+
+		h.Src = netip.AddrPortFrom(
+			netip.AddrFrom16([16]byte(payload[0:16])).Unmap(),
+			binary.BigEndian.Uint16(payload[32:34]),
+		)
+		h.Dst = netip.AddrPortFrom(
+			netip.AddrFrom16([16]byte(payload[16:32])).Unmap(),
+			binary.BigEndian.Uint16(payload[34:36]),
+		)
+	default:
+		// AF_UNSPEC or AF_UNIX, there are no usable addresses.
+		h.Local = true
+	}
+
+	return h, nil
+}
+
+// Format returns the binary representation of the header.
+func (h *Header) Format() (b []byte) {
+	if h.Version == V1 {
+		return h.formatV1()
+	}
+
+	return h.formatV2()
+}
+
+// WriteTo implements the [io.WriterTo] interface for *Header.
+func (h *Header) WriteTo(w io.Writer) (n int64, err error) {
+	written, err := w.Write(h.Format())
+
+	return int64(written), err
+}
+
+// formatV1 returns the v1 representation of the header.
+func (h *Header) formatV1() (b []byte) {
+	src, dst := h.Src.Addr(), h.Dst.Addr()
+
+	var proto string
+	switch {
+	case h.Local || !src.IsValid() || !dst.IsValid():
+		return []byte("PROXY UNKNOWN\r\n")
+	case src.Is4() && dst.Is4():
+		proto = "TCP4"
+	default:
+		// Mixed address families are represented as IPv6.
+		proto = "TCP6"
+		src, dst = as16(src), as16(dst)
+	}
+
+	return fmt.Appendf(
+		nil,
+		"PROXY %s %s %s %d %d\r\n",
+		proto,
+		src,
+		dst,
+		h.Src.Port(),
+		h.Dst.Port(),
+	)
+}
+
+// formatV2 returns the v2 representation of the header.
+func (h *Header) formatV2() (b []byte) {
+	b = append(b, v2Signature...)
+
+	src, dst := h.Src.Addr(), h.Dst.Addr()
+
+	var payload []byte
+	switch {
+	case h.Local || !src.IsValid() || !dst.IsValid():
+		// LOCAL command with AF_UNSPEC.
+		return append(b, 0x20, 0x00, 0x00, 0x00)
+	case src.Is4() && dst.Is4():
+		b = append(b, 0x21, 0x11)
+		payload = append(payload, src.AsSlice()...)
+		payload = append(payload, dst.AsSlice()...)
+	default:
+		b = append(b, 0x21, 0x21)
+		payload = append(payload, as16(src).AsSlice()...)
+		payload = append(payload, as16(dst).AsSlice()...)
+	}
+
+	payload = binary.BigEndian.AppendUint16(payload, h.Src.Port())
+	payload = binary.BigEndian.AppendUint16(payload, h.Dst.Port())
+
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+
+	return append(b, payload...)
+}
+
+// as16 converts addr to its 16-byte representation.
+func as16(addr netip.Addr) (res netip.Addr) {
+	return netip.AddrFrom16(addr.As16())
+}
@@ -0,0 +1,209 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/zamibd/gorao/internal/proxyproto"
+)
+
+// v2Signature is the signature every v2 header starts with.
+const v2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// v2 returns a v2 header with the version and command byte, the family byte,
+// the length field and the payload.
+func v2(verCmd, fam byte, length uint16, payload []byte) (b []byte) {
+	b = append([]byte(v2Signature), verCmd, fam)
+	b = binary.BigEndian.AppendUint16(b, length)
+
+	return append(b, payload...)
+}
+
+// v2Payload returns an IPv4 address block with 1.2.3.4:1000 as the source and
+// 5.6.7.8:443 as the destination.
+func v2Payload() (b []byte) {
+	return []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x03, 0xe8, 0x01, 0xbb}
+}
+
+func TestRead(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      []byte
+		want    *proxyproto.Header
+		wantErr string
+		noHdr   bool
+	}{{
+		name: "v1_tcp4",
+		in:   []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\n"),
+		want: &proxyproto.Header{
+			Src:     netip.MustParseAddrPort("1.2.3.4:1000"),
+			Dst:     netip.MustParseAddrPort("5.6.7.8:443"),
+			Version: proxyproto.V1,
+		},
+	}, {
+		name: "v1_tcp6",
+		in:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1000 443\r\n"),
+		want: &proxyproto.Header{
+			Src:     netip.MustParseAddrPort("[2001:db8::1]:1000"),
+			Dst:     netip.MustParseAddrPort("[2001:db8::2]:443"),
+			Version: proxyproto.V1,
+		},
+	}, {
+		name: "v1_unknown",
+		in:   []byte("PROXY UNKNOWN\r\n"),
+		want: &proxyproto.Header{Version: proxyproto.V1, Local: true},
+	}, {
+		name:    "v1_truncated",
+		in:      []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000"),
+		wantErr: "reading v1 header",
+	}, {
+		name:    "v1_too_long",
+		in:      []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"),
+		wantErr: "too long",
+	}, {
+		name:    "v1_unknown_family",
+		in:      []byte("PROXY UDP4 1.2.3.4 5.6.7.8 1000 443\r\n"),
+		wantErr: "unsupported v1 protocol",
+	}, {
+		name:    "v1_family_mismatch",
+		in:      []byte("PROXY TCP4 2001:db8::1 5.6.7.8 1000 443\r\n"),
+		wantErr: "non-ipv4",
+	}, {
+		name:    "v1_bad_port",
+		in:      []byte("PROXY TCP4 1.2.3.4 5.6.7.8 70000 443\r\n"),
+		wantErr: "bad v1 source",
+	}, {
+		name:    "v1_missing_fields",
+		in:      []byte("PROXY TCP4 1.2.3.4\r\n"),
+		wantErr: "malformed",
+	}, {
+		name: "v2_proxy_ipv4",
+		in:   v2(0x21, 0x11, 12, v2Payload()),
+		want: &proxyproto.Header{
+			Src:     netip.MustParseAddrPort("1.2.3.4:1000"),
+			Dst:     netip.MustParseAddrPort("5.6.7.8:443"),
+			Version: proxyproto.V2,
+		},
+	}, {
+		name: "v2_local",
+		in:   v2(0x20, 0x00, 0, nil),
+		want: &proxyproto.Header{Version: proxyproto.V2, Local: true},
+	}, {
+		name: "v2_local_with_addresses",
+		in:   v2(0x20, 0x11, 12, v2Payload()),
+		want: &proxyproto.Header{Version: proxyproto.V2, Local: true},
+	}, {
+		name: "v2_unspec_family",
+		in:   v2(0x21, 0x00, 0, nil),
+		want: &proxyproto.Header{Version: proxyproto.V2, Local: true},
+	}, {
+		name: "v2_unix_family",
+		in:   v2(0x21, 0x31, 0, nil),
+		want: &proxyproto.Header{Version: proxyproto.V2, Local: true},
+	}, {
+		name:    "v2_truncated_fixed_part",
+		in:      []byte(v2Signature + "\x21"),
+		wantErr: "reading v2 header",
+	}, {
+		name:    "v2_truncated_addresses",
+		in:      v2(0x21, 0x11, 12, v2Payload()[:6]),
+		wantErr: "reading v2 addresses",
+	}, {
+		name:    "v2_short_ipv4",
+		in:      v2(0x21, 0x11, 6, v2Payload()[:6]),
+		wantErr: "ipv4 addresses are too short",
+	}, {
+		name:    "v2_short_ipv6",
+		in:      v2(0x21, 0x21, 12, v2Payload()),
+		wantErr: "ipv6 addresses are too short",
+	}, {
+		name:    "v2_oversized",
+		in:      v2(0x21, 0x11, 0xffff, nil),
+		wantErr: "too long",
+	}, {
+		name:    "v2_bad_version",
+		in:      v2(0x11, 0x11, 12, v2Payload()),
+		wantErr: "unsupported v2 version",
+	}, {
+		name:    "v2_bad_command",
+		in:      v2(0x2f, 0x11, 12, v2Payload()),
+		wantErr: "unsupported v2 command",
+	}, {
+		name:  "tls",
+		in:    []byte("\x16\x03\x01\x02\x00"),
+		noHdr: true,
+	}, {
+		name:  "http",
+		in:    []byte("GET / HTTP/1.1\r\n"),
+		noHdr: true,
+	}, {
+		name:  "partial_v2_signature",
+		in:    []byte("\r\n\r\nGET / HTTP/1.1"),
+		noHdr: true,
+	}, {
+		name:    "empty",
+		in:      nil,
+		wantErr: "reading header",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tc.in))
+			h, err := proxyproto.Read(r)
+
+			switch {
+			case tc.noHdr:
+				if !errors.Is(err, proxyproto.ErrNoHeader) {
+					t.Fatalf("got error %v, want %v", err, proxyproto.ErrNoHeader)
+				}
+
+				rest, _ := io.ReadAll(r)
+				if !bytes.Equal(rest, tc.in) {
+					t.Fatalf("data is consumed: got %q, want %q", rest, tc.in)
+				}
+			case tc.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case *h != *tc.want:
+				t.Fatalf("got %+v, want %+v", h, tc.want)
+			}
+		})
+	}
+}
+
+func TestHeader_Format(t *testing.T) {
+	headers := []*proxyproto.Header{{
+		Src: netip.MustParseAddrPort("1.2.3.4:1000"),
+		Dst: netip.MustParseAddrPort("5.6.7.8:443"),
+	}, {
+		Src: netip.MustParseAddrPort("[2001:db8::1]:1000"),
+		Dst: netip.MustParseAddrPort("[2001:db8::2]:443"),
+	}, {
+		Local: true,
+	}}
+
+	for _, v := range []proxyproto.Version{proxyproto.V1, proxyproto.V2} {
+		for _, want := range headers {
+			want := *want
+			want.Version = v
+
+			h, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(want.Format())))
+			if err != nil {
+				t.Fatalf("%s %+v: %v", v, want, err)
+			}
+
+			if *h != want {
+				t.Fatalf("%s: got %+v, want %+v", v, h, want)
+			}
+		}
+	}
+}
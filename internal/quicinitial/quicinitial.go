@@ -0,0 +1,452 @@
+// Package quicinitial decrypts QUIC Initial packets and extracts the TLS
+// ClientHello from them.  The keys of Initial packets are derived from the
+// destination connection ID that is sent in clear, so anyone on the path can
+// decrypt them.  See RFC 9001, Section 5, and RFC 9369 for QUIC v2.
+package quicinitial
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	// Version1 is the QUIC version 1, RFC 9000.
+	Version1 uint32 = 0x00000001
+
+	// Version2 is the QUIC version 2, RFC 9369.
+	Version2 uint32 = 0x6b3343cf
+)
+
+// ErrNotInitial is returned when the datagram does not start with a QUIC
+// Initial packet of a supported version.
+var ErrNotInitial = errors.New("quicinitial: not an initial packet")
+
+var (
+	// saltV1 is the initial salt of QUIC v1.
+	saltV1 = []byte{
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	}
+
+	// saltV2 is the initial salt of QUIC v2.
+	saltV2 = []byte{
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	}
+)
+
+const (
+	// frameTypePadding is the type of PADDING frames.
+	frameTypePadding = 0x00
+
+	// frameTypePing is the type of PING frames.
+	frameTypePing = 0x01
+
+	// frameTypeACK and frameTypeACKECN are the types of ACK frames.
+	frameTypeACK    = 0x02
+	frameTypeACKECN = 0x03
+
+	// frameTypeCrypto is the type of CRYPTO frames.
+	frameTypeCrypto = 0x06
+
+	// frameTypeConnectionClose is the type of transport CONNECTION_CLOSE
+	// frames.
+	frameTypeConnectionClose = 0x1c
+)
+
+// CryptoFrame is the data of a CRYPTO frame.
+type CryptoFrame struct {
+	// Data is the frame data.
+	Data []byte
+
+	// Offset is the offset of the data in the crypto stream.
+	Offset uint64
+}
+
+// Packet is a decrypted Initial packet.
+type Packet struct {
+	// DCID is the destination connection ID.
+	DCID []byte
+
+	// SCID is the source connection ID.
+	SCID []byte
+
+	// Crypto are the CRYPTO frames of the packet.
+	Crypto []CryptoFrame
+
+	// Version is the QUIC version.
+	Version uint32
+}
+
+// Parse decrypts the first Initial packet of the datagram sent by a client.
+// It returns ErrNotInitial if the datagram does not start with an Initial
+// packet of a supported version.
+func Parse(datagram []byte) (p *Packet, err error) {
+	if len(datagram) < 7 || datagram[0]&0x80 == 0 {
+		return nil, ErrNotInitial
+	}
+
+	version := binary.BigEndian.Uint32(datagram[1:])
+	if !isInitial(datagram[0], version) {
+		return nil, ErrNotInitial
+	}
+
+	p = &Packet{
+		Version: version,
+	}
+
+	b := datagram[5:]
+	if p.DCID, b, err = readShortVector(b); err != nil {
+		return nil, fmt.Errorf("quicinitial: reading dcid: %w", err)
+	}
+
+	if p.SCID, b, err = readShortVector(b); err != nil {
+		return nil, fmt.Errorf("quicinitial: reading scid: %w", err)
+	}
+
+	tokenLen, b, err := readVarint(b)
+	if err != nil || tokenLen > uint64(len(b)) {
+		return nil, errors.New("quicinitial: bad token length")
+	}
+
+	b = b[tokenLen:]
+
+	length, b, err := readVarint(b)
+	if err != nil || length > uint64(len(b)) {
+		return nil, errors.New("quicinitial: bad packet length")
+	}
+
+	pnOffset := len(datagram) - len(b)
+	packet := slices.Clone(datagram[:pnOffset+int(length)])
+
+	payload, err := decrypt(packet, pnOffset, p.DCID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Crypto, err = parseFrames(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// isInitial returns true if the long header with the first byte and the
+// version is the header of an Initial packet.
+func isInitial(first byte, version uint32) (ok bool) {
+	typ := (first & 0x30) >> 4
+	switch version {
+	case Version1:
+		return typ == 0
+	case Version2:
+		return typ == 1
+	default:
+		return false
+	}
+}
+
+// decrypt removes the header protection of the packet and decrypts its
+// payload in place.
+func decrypt(packet []byte, pnOffset int, dcid []byte, version uint32) (payload []byte, err error) {
+	key, iv, hp, err := clientKeys(dcid, version)
+	if err != nil {
+		return nil, fmt.Errorf("quicinitial: deriving keys: %w", err)
+	}
+
+	// The sample is taken as if the packet number was 4 bytes long.
+	if len(packet) < pnOffset+4+aes.BlockSize {
+		return nil, errors.New("quicinitial: packet is too short")
+	}
+
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, fmt.Errorf("quicinitial: %w", err)
+	}
+
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	packet[0] ^= mask[0] & 0x0f
+	pnLen := int(packet[0]&0x03) + 1
+
+	var pn uint64
+	for i := range pnLen {
+		packet[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(packet[pnOffset+i])
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("quicinitial: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("quicinitial: %w", err)
+	}
+
+	// The nonce is the IV XORed with the packet number.  The packet number is
+	// not decoded relative to the largest acknowledged one, the clients start
+	// from zero and there are only a few Initial packets.
+	nonce := slices.Clone(iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	header := packet[:pnOffset+pnLen]
+	payload, err = aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, fmt.Errorf("quicinitial: decrypting packet: %w", err)
+	}
+
+	return payload, nil
+}
+
+// clientKeys derives the client Initial key, IV and header protection key.
+func clientKeys(dcid []byte, version uint32) (key, iv, hp []byte, err error) {
+	salt, prefix := saltV1, "quic "
+	if version == Version2 {
+		salt, prefix = saltV2, "quicv2 "
+	}
+
+	initial, err := hkdf.Extract(sha256.New, dcid, salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	secret, err := expandLabel(initial, "client in", sha256.Size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if key, err = expandLabel(secret, prefix+"key", 16); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if iv, err = expandLabel(secret, prefix+"iv", 12); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if hp, err = expandLabel(secret, prefix+"hp", 16); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return key, iv, hp, nil
+}
+
+// expandLabel implements HKDF-Expand-Label from RFC 8446 with an empty
+// context.
+func expandLabel(secret []byte, label string, length int) (res []byte, err error) {
+	label = "tls13 " + label
+
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// parseFrames parses the frames of a decrypted Initial packet and returns
+// the CRYPTO ones.
+func parseFrames(b []byte) (frames []CryptoFrame, err error) {
+	for len(b) > 0 {
+		var typ uint64
+		typ, b, err = readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case frameTypePadding, frameTypePing:
+			// No payload.
+		case frameTypeCrypto:
+			var f CryptoFrame
+			f, b, err = readCryptoFrame(b)
+			if err != nil {
+				return nil, err
+			}
+
+			frames = append(frames, f)
+		case frameTypeACK, frameTypeACKECN:
+			b, err = skipACKFrame(b, typ == frameTypeACKECN)
+			if err != nil {
+				return nil, err
+			}
+		case frameTypeConnectionClose:
+			// The rest of the packet doesn't matter.
+			return frames, nil
+		default:
+			return nil, fmt.Errorf("quicinitial: unexpected frame type 0x%x", typ)
+		}
+	}
+
+	return frames, nil
+}
+
+// readCryptoFrame reads the CRYPTO frame without the type.
+func readCryptoFrame(b []byte) (f CryptoFrame, rest []byte, err error) {
+	f.Offset, b, err = readVarint(b)
+	if err != nil {
+		return f, nil, err
+	}
+
+	n, b, err := readVarint(b)
+	if err != nil {
+		return f, nil, err
+	}
+
+	if n > uint64(len(b)) {
+		return f, nil, errors.New("quicinitial: crypto frame is too short")
+	}
+
+	f.Data = b[:n]
+
+	return f, b[n:], nil
+}
+
+// skipACKFrame skips the ACK frame without the type.
+func skipACKFrame(b []byte, ecn bool) (rest []byte, err error) {
+	// Largest Acknowledged, ACK Delay, ACK Range Count and First ACK Range.
+	var rangeCount uint64
+	for i := range 4 {
+		var v uint64
+		v, b, err = readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 2 {
+			rangeCount = v
+		}
+	}
+
+	// Gap and ACK Range Length of every range, then three ECN counts.
+	n := 2 * rangeCount
+	if ecn {
+		n += 3
+	}
+
+	for range n {
+		_, b, err = readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// readShortVector reads a vector with a single-byte length.
+func readShortVector(b []byte) (v, rest []byte, err error) {
+	if len(b) < 1 || int(b[0]) > len(b)-1 {
+		return nil, nil, errors.New("vector is too short")
+	}
+
+	n := int(b[0])
+
+	return b[1 : 1+n], b[1+n:], nil
+}
+
+// readVarint reads a QUIC variable-length integer.
+func readVarint(b []byte) (v uint64, rest []byte, err error) {
+	if len(b) == 0 {
+		return 0, nil, errors.New("quicinitial: varint is too short")
+	}
+
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, nil, errors.New("quicinitial: varint is too short")
+	}
+
+	v = uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+
+	return v, b[n:], nil
+}
+
+// maxCryptoLen is the maximum length of the crypto stream that is
+// reassembled.  Real ClientHello messages are much shorter.
+const maxCryptoLen = 64 * 1024
+
+// Assembler reassembles the ClientHello from the CRYPTO frames that may be
+// split between several Initial packets and arrive out of order.
+type Assembler struct {
+	// buf is the crypto stream received so far.
+	buf []byte
+
+	// received marks the bytes of buf that have been received.
+	received []bool
+}
+
+// Add adds the data of the CRYPTO frames to the stream.
+func (a *Assembler) Add(frames []CryptoFrame) (err error) {
+	for _, f := range frames {
+		end := f.Offset + uint64(len(f.Data))
+		if end > maxCryptoLen {
+			return errors.New("quicinitial: crypto stream is too long")
+		}
+
+		if int(end) > len(a.buf) {
+			a.buf = append(a.buf, make([]byte, int(end)-len(a.buf))...)
+			a.received = append(a.received, make([]bool, int(end)-len(a.received))...)
+		}
+
+		copy(a.buf[f.Offset:], f.Data)
+		for i := f.Offset; i < end; i++ {
+			a.received[i] = true
+		}
+	}
+
+	return nil
+}
+
+// ClientHello returns the ClientHello handshake message if it has been
+// received completely.
+func (a *Assembler) ClientHello() (msg []byte, ok bool) {
+	n := slices.Index(a.received, false)
+	if n == -1 {
+		n = len(a.received)
+	}
+
+	if n < 4 {
+		return nil, false
+	}
+
+	msgLen := 4 + (int(a.buf[1])<<16 | int(a.buf[2])<<8 | int(a.buf[3]))
+	if n < msgLen {
+		return nil, false
+	}
+
+	return a.buf[:msgLen], true
+}
+
+// maxRecordLen is the maximum length of a TLS record payload.
+const maxRecordLen = 16384
+
+// Records wraps the handshake message into TLS handshake records so that it
+// could be parsed by the code that expects a TLS stream.
+func Records(msg []byte) (records []byte) {
+	buf := &bytes.Buffer{}
+	for len(msg) > 0 {
+		n := min(len(msg), maxRecordLen)
+
+		// Content type handshake, legacy version TLS 1.0, length.
+		buf.Write([]byte{22, 0x03, 0x01, byte(n >> 8), byte(n)})
+		buf.Write(msg[:n])
+
+		msg = msg[n:]
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,443 @@
+package quicinitial
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// mustHex decodes the hex string s ignoring whitespace.
+func mustHex(t testing.TB, s string) (b []byte) {
+	t.Helper()
+
+	b, err := hex.DecodeString(string(bytes.Join(bytes.Fields([]byte(s)), nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// rfcDCID is the destination connection ID of the client Initial packet from
+// RFC 9001, Appendix A.
+const rfcDCID = "8394c8f03e515708"
+
+// rfcCryptoFrame is a CRYPTO frame with a 237-byte ClientHello for
+// example.com.  It starts with the same bytes as the one of the client Initial
+// packet from RFC 9001, Appendix A.2, so the protected header and the header
+// protection sample match the ones in the RFC.
+const rfcCryptoFrame = `
+060040f1010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e868
+04fe3a47f06a2b69484c00000413011302010000c000000010000e00000b6578
+616d706c652e636f6dff01000100000a00080006001d00170018001000070005
+04616c706e000500050100000000003300260024001d00209370b2c9caa47fba
+baf4fe1f44a3fa28c9e3d3c3b3bfa9a0fe0e31f0f2b6f7d4c00c0d000000000b
+00160014040305030603020302020603020108040805080600002d0002010100
+1c00024001003900320408ffffffffffffffff05048000ffff07048000ffff08
+01100104800075300901100f088394c8f03e515708`
+
+// rfcHeader is the unprotected header of the client Initial packet from RFC
+// 9001, Appendix A.2, with the 4-byte packet number 2.
+const rfcHeader = "c300000001088394c8f03e5157080000449e00000002"
+
+// protect encrypts the payload of the client Initial packet with the
+// unprotected header and applies the header protection as described in RFC
+// 9001, Section 5.  The packet number must be 4 bytes long.
+func protect(t testing.TB, header, payload, dcid []byte, version uint32) (packet []byte) {
+	t.Helper()
+
+	key, iv, hp, err := clientKeys(dcid, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pnOffset := len(header) - 4
+	nonce := slices.Clone(iv)
+	for i, c := range header[pnOffset:] {
+		nonce[len(nonce)-4+i] ^= c
+	}
+
+	packet = aead.Seal(slices.Clone(header), nonce, payload, header)
+
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	packet[0] ^= mask[0] & 0x0f
+	for i := range 4 {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+
+	return packet
+}
+
+// rfcPacket returns the protected 1200-byte client Initial packet with the
+// header of the one from RFC 9001, Appendix A.2, and rfcCryptoFrame.
+func rfcPacket(t testing.TB) (packet []byte) {
+	t.Helper()
+
+	// The CRYPTO frame is padded to 1162 bytes so that the datagram is 1200
+	// bytes long.
+	payload := mustHex(t, rfcCryptoFrame)
+	payload = append(payload, make([]byte, 1162-len(payload))...)
+
+	return protect(t, mustHex(t, rfcHeader), payload, mustHex(t, rfcDCID), Version1)
+}
+
+func TestClientKeys(t *testing.T) {
+	testCases := []struct {
+		name    string
+		key     string
+		iv      string
+		hp      string
+		version uint32
+	}{{
+		// RFC 9001, Appendix A.1.
+		name:    "v1",
+		key:     "1f369613dd76d5467730efcbe3b1a22d",
+		iv:      "fa044b2f42a3fd3b46fb255c",
+		hp:      "9f50449e04a0e810283a1e9933adedd2",
+		version: Version1,
+	}, {
+		// RFC 9369, Appendix A.1.
+		name:    "v2",
+		key:     "8b1a0bc121284290a29e0971b5cd045d",
+		iv:      "91f73e2351d8fa91660e909f",
+		hp:      "45b95e15235d6f45a6b19cbcb0294ba9",
+		version: Version2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, iv, hp, err := clientKeys(mustHex(t, rfcDCID), tc.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				name string
+				got  []byte
+				want string
+			}{{"key", key, tc.key}, {"iv", iv, tc.iv}, {"hp", hp, tc.hp}} {
+				if got := hex.EncodeToString(c.got); got != c.want {
+					t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParse_rfc9001(t *testing.T) {
+	packet := rfcPacket(t)
+	if len(packet) != 1200 {
+		t.Fatalf("packet length: got %d, want 1200", len(packet))
+	}
+
+	// The protected header and the sample from RFC 9001, Appendix A.2.
+	wantHeader := "c000000001088394c8f03e5157080000449e7b9aec34"
+	if got := hex.EncodeToString(packet[:len(wantHeader)/2]); got != wantHeader {
+		t.Fatalf("protected header: got %s, want %s", got, wantHeader)
+	}
+
+	wantSample := "d1b1c98dd7689fb8ec11d242b123dc9b"
+	if got := hex.EncodeToString(packet[22 : 22+16]); got != wantSample {
+		t.Fatalf("sample: got %s, want %s", got, wantSample)
+	}
+
+	p, err := Parse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Version != Version1 || !bytes.Equal(p.DCID, mustHex(t, rfcDCID)) || len(p.SCID) != 0 {
+		t.Fatalf("bad header: version %x, dcid %x, scid %x", p.Version, p.DCID, p.SCID)
+	}
+
+	if len(p.Crypto) != 1 || p.Crypto[0].Offset != 0 || len(p.Crypto[0].Data) != 0xf1 {
+		t.Fatalf("bad crypto frames: %+v", p.Crypto)
+	}
+
+	a := &Assembler{}
+	if err = a.Add(p.Crypto); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok := a.ClientHello()
+	if !ok {
+		t.Fatal("client hello is incomplete")
+	}
+
+	if len(msg) != 0xf1 || !bytes.Contains(msg, []byte("example.com")) {
+		t.Fatalf("bad client hello %x", msg)
+	}
+}
+
+func TestParse_v2(t *testing.T) {
+	// Long header type 1 is Initial in QUIC v2.
+	header := mustHex(t, "d36b3343cf088394c8f03e5157080000449e00000002")
+	payload := mustHex(t, rfcCryptoFrame)
+	payload = append(payload, make([]byte, 1162-len(payload))...)
+
+	p, err := Parse(protect(t, header, payload, mustHex(t, rfcDCID), Version2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Version != Version2 || len(p.Crypto) != 1 {
+		t.Fatalf("bad packet: %+v", p)
+	}
+}
+
+func TestParse_bad(t *testing.T) {
+	packet := rfcPacket(t)
+
+	testCases := []struct {
+		name    string
+		in      []byte
+		notInit bool
+	}{{
+		name:    "empty",
+		in:      nil,
+		notInit: true,
+	}, {
+		name:    "short_header",
+		in:      append([]byte{0x40}, packet[1:]...),
+		notInit: true,
+	}, {
+		name:    "unknown_version",
+		in:      append([]byte{0xc0, 0, 0, 0, 3}, packet[5:]...),
+		notInit: true,
+	}, {
+		name:    "handshake_packet",
+		in:      append([]byte{0xe0}, packet[1:]...),
+		notInit: true,
+	}, {
+		name: "bad_token_length",
+		in:   append(slices.Clone(packet[:16]), 0x7f, 0xff),
+	}, {
+		name: "bad_packet_length",
+		in:   append(slices.Clone(packet[:17]), 0x7f, 0xff),
+	}, {
+		name: "tampered",
+		in:   append(slices.Clone(packet[:len(packet)-1]), packet[len(packet)-1]^1),
+	}, {
+		name: "wrong_dcid",
+		in:   append(append(slices.Clone(packet[:6]), 0x00), packet[7:]...),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.in)
+			if err == nil {
+				t.Fatal("no error")
+			}
+
+			if notInit := errors.Is(err, ErrNotInitial); notInit != tc.notInit {
+				t.Fatalf("got error %v, want not initial %t", err, tc.notInit)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		for i := range len(packet) {
+			if _, err := Parse(packet[:i]); err == nil {
+				t.Fatalf("no error for %d bytes", i)
+			}
+		}
+	})
+}
+
+func TestParseFrames(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		want    []CryptoFrame
+		wantErr bool
+	}{{
+		name: "padding_ping_crypto",
+		in:   "0000 01 06 00 03 616263 0000",
+		want: []CryptoFrame{{Data: []byte("abc"), Offset: 0}},
+	}, {
+		name: "ack_and_crypto",
+		in:   "02 05 00 01 00 01 02 06 4005 01 78",
+		want: []CryptoFrame{{Data: []byte("x"), Offset: 5}},
+	}, {
+		name: "ack_ecn",
+		in:   "03 05 00 00 00 01 02 03 06 00 01 78",
+		want: []CryptoFrame{{Data: []byte("x"), Offset: 0}},
+	}, {
+		name: "connection_close",
+		in:   "06 00 01 78 1c ffff",
+		want: []CryptoFrame{{Data: []byte("x"), Offset: 0}},
+	}, {
+		name:    "truncated_crypto",
+		in:      "06 00 05 6162",
+		wantErr: true,
+	}, {
+		name:    "truncated_varint",
+		in:      "06 40",
+		wantErr: true,
+	}, {
+		name:    "truncated_ack",
+		in:      "02 05 00 05",
+		wantErr: true,
+	}, {
+		name:    "unexpected_frame",
+		in:      "08 00",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseFrames(mustHex(t, tc.in))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %+v", got)
+				}
+
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+
+			for i := range got {
+				if got[i].Offset != tc.want[i].Offset || !bytes.Equal(got[i].Data, tc.want[i].Data) {
+					t.Fatalf("frame %d: got %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	// A ClientHello-like handshake message with a 6-byte body.
+	msg := []byte{0x01, 0x00, 0x00, 0x06, 'a', 'b', 'c', 'd', 'e', 'f'}
+
+	testCases := []struct {
+		name    string
+		frames  []CryptoFrame
+		wantOK  bool
+		wantErr bool
+	}{{
+		name:   "single",
+		frames: []CryptoFrame{{Data: msg}},
+		wantOK: true,
+	}, {
+		name: "out_of_order",
+		frames: []CryptoFrame{
+			{Data: msg[6:], Offset: 6},
+			{Data: msg[2:6], Offset: 2},
+			{Data: msg[:2]},
+		},
+		wantOK: true,
+	}, {
+		name: "overlapping",
+		frames: []CryptoFrame{
+			{Data: msg[:7]},
+			{Data: msg[3:], Offset: 3},
+		},
+		wantOK: true,
+	}, {
+		name: "gap",
+		frames: []CryptoFrame{
+			{Data: msg[:4]},
+			{Data: msg[6:], Offset: 6},
+		},
+	}, {
+		name:   "header_only",
+		frames: []CryptoFrame{{Data: msg[:3]}},
+	}, {
+		name:   "missing_tail",
+		frames: []CryptoFrame{{Data: msg[:9]}},
+	}, {
+		name:    "too_long",
+		frames:  []CryptoFrame{{Data: []byte{1}, Offset: maxCryptoLen}},
+		wantErr: true,
+	}, {
+		name:    "huge_offset",
+		frames:  []CryptoFrame{{Data: []byte{1}, Offset: 1 << 62}},
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &Assembler{}
+
+			var err error
+			for _, f := range tc.frames {
+				if err = a.Add([]CryptoFrame{f}); err != nil {
+					break
+				}
+			}
+
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+
+			got, ok := a.ClientHello()
+			if ok != tc.wantOK {
+				t.Fatalf("got ok %t, want %t", ok, tc.wantOK)
+			}
+
+			if ok && !bytes.Equal(got, msg) {
+				t.Fatalf("got %x, want %x", got, msg)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(rfcPacket(f))
+	f.Add([]byte{0xc0, 0, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		a := &Assembler{}
+		if err = a.Add(p.Crypto); err == nil {
+			_, _ = a.ClientHello()
+		}
+	})
+}
+
+func FuzzParseFrames(f *testing.F) {
+	f.Add(mustHex(f, rfcCryptoFrame))
+	f.Add(mustHex(f, "02 05 00 01 00 01 02 06 4005 01 78"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frames, err := parseFrames(data)
+		if err != nil {
+			return
+		}
+
+		a := &Assembler{}
+		if err = a.Add(frames); err == nil {
+			_, _ = a.ClientHello()
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package gorao
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// unixPrefix is the prefix of the backend addresses that are paths to Unix
+// sockets.
+const unixPrefix = "unix:"
+
+// validateBackendRules checks the backend addresses of the backend rules.
+func validateBackendRules(rules map[string]string) (err error) {
+	for r, addr := range rules {
+		if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+			if path == "" {
+				return fmt.Errorf("gorao: backend rule %s: empty unix socket path", r)
+			}
+
+			continue
+		}
+
+		host := addr
+		if h, _, sErr := netutil.SplitHostPort(addr); sErr == nil {
+			host = h
+		}
+
+		if host == "" || strings.ContainsAny(host, " /") {
+			return fmt.Errorf("gorao: backend rule %s: bad backend address %q", r, addr)
+		}
+	}
+
+	return nil
+}
+
+// setBackend replaces the remote address of the connection with the backend
+// from the matching backend rule.  The backend may be a host:port pair, a host
+// or an IP address without port, in which case the original port is kept, or
+// a path to a Unix socket.
+func (p *Gorao) setBackend(ctx *SNIContext) {
+	addr, r, ok := p.backendRules.Match(ctx.target())
+	if !ok {
+		return
+	}
+
+	if !isUnixAddr(addr) {
+		if _, _, err := netutil.SplitHostPort(addr); err != nil {
+			// No port, keep the original one.
+			_, port, _ := netutil.SplitHostPort(ctx.RemoteAddr)
+			addr = netutil.JoinHostPort(addr, port)
+		}
+	}
+
+	log.Debug("gorao: [%d] backend rule %s: connecting to %s instead of %s", ctx.ID, r, addr, ctx.RemoteAddr)
+
+	ctx.RemoteAddr = addr
+}
+
+// dialUnix connects to the Unix socket backend.  Such backends are always
+// local, so they're never connected to through the upstream proxies.
+func dialUnix(addr string, timeout time.Duration) (conn net.Conn, err error) {
+	path := strings.TrimPrefix(addr, unixPrefix)
+
+	return net.DialTimeout("unix", path, timeout)
+}
+
+// isUnixAddr returns true if addr is a path to a Unix socket.
+func isUnixAddr(addr string) (ok bool) {
+	return strings.HasPrefix(addr, unixPrefix)
+}
@@ -0,0 +1,123 @@
+package gorao
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+// BlockResponse defines how the proxy rejects the blocked connections.
+type BlockResponse string
+
+const (
+	// BlockResponseClose means that the connection is closed silently.
+	BlockResponseClose BlockResponse = "close"
+
+	// BlockResponseRST means that the connection is reset with a TCP RST.
+	BlockResponseRST BlockResponse = "rst"
+
+	// BlockResponseAccessDenied means that the TLS access_denied alert is sent
+	// in response to the ClientHello before the connection is closed.
+	BlockResponseAccessDenied BlockResponse = "access_denied"
+
+	// BlockResponseUnrecognizedName means that the TLS unrecognized_name alert
+	// is sent in response to the ClientHello before the connection is closed.
+	BlockResponseUnrecognizedName BlockResponse = "unrecognized_name"
+)
+
+// ParseBlockResponse parses the block response from its string
+// representation.  An empty string is mapped to BlockResponseClose.
+func ParseBlockResponse(s string) (r BlockResponse, err error) {
+	switch r = BlockResponse(s); r {
+	case "":
+		return BlockResponseClose, nil
+	case BlockResponseClose, BlockResponseRST, BlockResponseAccessDenied, BlockResponseUnrecognizedName:
+		return r, nil
+	default:
+		return "", fmt.Errorf("gorao: unsupported block response %q", s)
+	}
+}
+
+// alert returns the description of the TLS alert the response sends, see RFC
+// 8446, section 6.  ok is false if the response isn't an alert.
+func (r BlockResponse) alert() (desc byte, ok bool) {
+	switch r {
+	case BlockResponseAccessDenied:
+		return 49, true
+	case BlockResponseUnrecognizedName:
+		return 112, true
+	default:
+		return 0, false
+	}
+}
+
+// lingerPeriod is the time the client connection is kept half-closed after
+// the rejection is sent so that the client reads it before the connection is
+// closed.
+const lingerPeriod = 500 * time.Millisecond
+
+// reject responds to the connection accepted with the protocol and blocked by
+// rule according to the block response that matches it.  Plain HTTP requests
+// get the block page unless the response is BlockResponseRST.
+func (p *Gorao) reject(ctx *SNIContext, clientConn net.Conn, proto Protocol, rule *filter.Rule) {
+	resp, _, ok := p.blockResponses.Match(ctx.target())
+	if !ok {
+		resp = BlockResponseClose
+	}
+
+	if resp == BlockResponseRST {
+		log.Debug("gorao: [%d] resetting blocked connection", ctx.ID)
+
+		setLingerZero(clientConn)
+
+		return
+	}
+
+	switch desc, isAlert := resp.alert(); {
+	case proto == ProtocolHTTP:
+		p.writeBlockPage(ctx, clientConn, rule)
+	case proto == ProtocolTLS && isAlert:
+		writeAlert(ctx, clientConn, desc)
+	}
+}
+
+// writeAlert sends the fatal TLS alert with the description to the client and
+// half-closes the connection.
+func writeAlert(ctx *SNIContext, clientConn net.Conn, desc byte) {
+	// ContentType alert, TLS 1.2 record version, length 2, level fatal.
+	record := []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, desc}
+	if _, err := clientConn.Write(record); err != nil {
+		log.Debug("gorao: [%d] failed to write tls alert: %v", ctx.ID, err)
+
+		return
+	}
+
+	log.Debug("gorao: [%d] sent tls alert %d", ctx.ID, desc)
+
+	lingerClose(clientConn)
+}
+
+// lingerClose half-closes conn and discards what the client still sends for
+// lingerPeriod.  Closing the connection with unread data right away makes the
+// kernel send a TCP RST that may destroy the response before the client reads
+// it.
+func lingerClose(conn net.Conn) {
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		return
+	}
+
+	if err := cw.CloseWrite(); err != nil {
+		return
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(lingerPeriod)); err != nil {
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, conn)
+}
@@ -0,0 +1,137 @@
+package gorao
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+// defaultBlockPageStatus is the status code of the block page if it isn't
+// configured.
+const defaultBlockPageStatus = http.StatusForbidden
+
+// defaultBlockPageTemplate is the body of the block page if the template isn't
+// configured.
+const defaultBlockPageTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Blocked</title></head>
+<body>
+<h1>Access to {{.Host}} is blocked</h1>
+<p>The request matches the block rule <code>{{.Rule}}</code>.</p>
+</body>
+</html>
+`
+
+// blockPage is the response to the blocked plain HTTP requests.
+type blockPage struct {
+	tmpl     *template.Template
+	redirect string
+	status   int
+}
+
+// blockPageData is the data the block page template is executed with.
+type blockPageData struct {
+	// Host is the requested host without port.
+	Host string
+
+	// Rule is the block rule the request matches.
+	Rule string
+}
+
+// newBlockPage creates the block page from the configuration.  bp is nil if
+// the blocked plain HTTP requests get no response.
+func newBlockPage(cfg *Config) (bp *blockPage, err error) {
+	if cfg.BlockPageStatus == 0 && cfg.BlockPageTemplate == "" && cfg.BlockPageRedirect == "" {
+		return nil, nil
+	}
+
+	bp = &blockPage{
+		redirect: cfg.BlockPageRedirect,
+		status:   defaultBlockPageStatus,
+	}
+
+	if cfg.BlockPageStatus != 0 {
+		if cfg.BlockPageStatus < 400 || cfg.BlockPageStatus > 599 {
+			return nil, fmt.Errorf("gorao: block page: status %d is not an error", cfg.BlockPageStatus)
+		}
+
+		bp.status = cfg.BlockPageStatus
+	}
+
+	if bp.redirect != "" {
+		u, pErr := url.Parse(bp.redirect)
+		if pErr != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("gorao: block page: bad redirect url %q", bp.redirect)
+		}
+	}
+
+	text := defaultBlockPageTemplate
+	if cfg.BlockPageTemplate != "" {
+		text = cfg.BlockPageTemplate
+	}
+
+	bp.tmpl, err = template.New("block page").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("gorao: block page: %w", err)
+	}
+
+	return bp, nil
+}
+
+// writeBlockPage sends the block page for the request blocked by rule to the
+// client and half-closes the connection.  It returns false if there is no
+// block page configured.
+func (p *Gorao) writeBlockPage(ctx *SNIContext, clientConn net.Conn, rule *filter.Rule) (ok bool) {
+	bp := p.blockPage
+	if bp == nil {
+		return false
+	}
+
+	body := &bytes.Buffer{}
+	err := bp.tmpl.Execute(body, blockPageData{
+		Host: ctx.RemoteHost,
+		Rule: rule.String(),
+	})
+	if err != nil {
+		log.Error("gorao: [%d] failed to execute block page template: %v", ctx.ID, err)
+
+		return false
+	}
+
+	resp := &http.Response{
+		StatusCode:    bp.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+	}
+
+	if bp.redirect != "" {
+		resp.StatusCode = http.StatusFound
+		resp.Header.Set("Location", bp.redirect)
+	}
+
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+
+	if err = resp.Write(clientConn); err != nil {
+		log.Debug("gorao: [%d] failed to write block page: %v", ctx.ID, err)
+
+		return true
+	}
+
+	log.Debug("gorao: [%d] sent block page with status %d", ctx.ID, resp.StatusCode)
+
+	lingerClose(clientConn)
+
+	return true
+}
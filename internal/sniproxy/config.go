@@ -1,18 +1,46 @@
 package gorao
 
 import (
-	"net"
+	"net/netip"
+	"time"
+
+	"github.com/zamibd/gorao/internal/drop"
+	"github.com/zamibd/gorao/internal/fault"
+	"github.com/zamibd/gorao/internal/proxypool"
+	"github.com/zamibd/gorao/internal/proxyproto"
 )
 
-// Config is the SNI proxy configuration.
+// Config is the SNI proxy configuration.  The connection rules are hostname
+// wildcards that may be narrowed down with qualifiers, see filter.Rule.
 type Config struct {
-	// TLSListenAddr is the listen address the SNI proxy will be listening to
-	// TLS connections.
-	TLSListenAddr *net.TCPAddr
+	// Listeners is the list of listeners the SNI proxy accepts connections
+	// on.  Their names must be unique.
+	Listeners []*ListenerConfig
+
+	// ProxyProtocolTrusted is a list of networks that are allowed to send
+	// PROXY protocol headers.  It is required if any listener parses them.
+	ProxyProtocolTrusted []netip.Prefix
+
+	// NoServerNameAction defines what happens to the connections without a
+	// server name or with a TLS server name that is an IP address.
+	NoServerNameAction NoServerNameAction
 
-	// HTTPListenAddr is the listen address the SNI proxy will be listening to
-	// plain HTTP connections.
-	HTTPListenAddr *net.TCPAddr
+	// NoServerNameBackend is the host:port the connections without a server
+	// name are tunneled to, see NoServerNameAction.
+	NoServerNameBackend string
+
+	// BackendRules is a map that overrides the address the proxy connects to
+	// for the connections that match the rules.  The value is either a
+	// host:port pair, a host or an IP address without port, in which case the
+	// original port is used, or a path to a Unix socket prefixed with
+	// "unix:".  Unix socket backends are never connected to through the
+	// upstream proxies.
+	BackendRules map[string]string
+
+	// ProxyProtocolRules is a map that defines which PROXY protocol version
+	// header will be sent to the backends for connections that match the
+	// rules.  The header carries the original client address.
+	ProxyProtocolRules map[string]proxyproto.Version
 
 	// ForwardProxy is the address of the SOCKS5 proxy that the connections will
 	// be forwarded to according to ForwardRules.
@@ -23,15 +51,131 @@ type Config struct {
 	// ForwardProxy is set, all connections will be forwarded.
 	ForwardRules []string
 
+	// ForwardProxies is a map of named upstream proxies.  The key is the name
+	// of the upstream that can be used in ForwardRoutes, the value is the
+	// proxy URL.  If the value contains several comma-separated URLs, the
+	// upstream is a pool of proxies.  The names UpstreamDirect and
+	// UpstreamDefault are reserved.
+	ForwardProxies map[string]string
+
+	// ForwardPoolStrategies maps the names of the upstream pools to the
+	// strategies used to choose a proxy from them.  The default strategy is
+	// [proxypool.RoundRobin].
+	ForwardPoolStrategies map[string]proxypool.Strategy
+
+	// ForwardHealthCheckInterval is the interval between active health checks
+	// of the proxies in the upstream pools.  If zero, only passive failure
+	// detection is used.
+	ForwardHealthCheckInterval time.Duration
+
+	// ForwardHealthCheckProbe is the address that health checks connect to
+	// through the proxies.  If empty, health checks just connect to the
+	// proxies.
+	ForwardHealthCheckProbe string
+
+	// ForwardRoutes is a map of wildcards to the names of the upstreams from
+	// ForwardProxies the matching connections will be forwarded to.
+	// UpstreamDirect means that the connection is not forwarded.  Has higher
+	// priority than ForwardRules.
+	ForwardRoutes map[string]string
+
+	// DNSUpstream is the DNS upstream that is used to resolve the hostnames of
+	// the backends and the upstream proxies.  The format is the one that is
+	// accepted by [upstream.AddressToUpstream].  If empty, the system resolver
+	// is used.
+	DNSUpstream string
+
+	// SelfAddrs is a list of IP addresses that point to gorao itself, e.g. the
+	// addresses the DNS proxy redirects queries to.  Direct connections to
+	// these addresses on ports 80, 443, the destination ports of the listeners
+	// and the ports of the listeners are refused to prevent loops, as well as
+	// the ones to gorao's own listen addresses.
+	SelfAddrs []netip.Addr
+
+	// OriginalDstRules is a list of rules that define which connections
+	// accepted by the transparent listeners are tunneled to their original
+	// destination address instead of the server name.  The connections
+	// without a server name and the ones originally sent to ports other than
+	// 80 and 443 are always tunneled to the original destination.
+	OriginalDstRules []string
+
 	// BlockRules is a list of wildcards that define connections to which hosts
 	// will be blocked.
 	BlockRules []string
 
+	// BlockResponses maps rules to the ways the matching blocked connections
+	// are rejected.  They don't block connections by themselves.  The
+	// connections that match no rule are closed silently, the TLS alerts are
+	// only sent on the TLS listeners.
+	BlockResponses map[string]BlockResponse
+
+	// BlockPageStatus is the status code of the response to the blocked plain
+	// HTTP requests.  If zero, 403 is used when BlockPageTemplate or
+	// BlockPageRedirect is set, otherwise such connections are closed without
+	// a response.
+	BlockPageStatus int
+
+	// BlockPageTemplate is the html/template of the response body to the
+	// blocked plain HTTP requests.  {{.Host}} and {{.Rule}} are replaced with
+	// the requested host and the matched block rule.  If empty, a built-in
+	// page is used.
+	BlockPageTemplate string
+
+	// BlockPageRedirect is the URL the blocked plain HTTP requests are
+	// redirected to with 302 Found instead of BlockPageStatus.
+	BlockPageRedirect string
+
 	// DropRules is a list of wildcards that define connections to which hosts
-	// will be dropped. "Dropped" means that they will be delayed for a specific
-	// period of time.
+	// will be dropped. "Dropped" means that they will be delayed for
+	// DropPeriod.
 	DropRules []string
 
+	// DropActions maps rules to the ways the matching connections are
+	// dropped.  Has higher priority than DropRules.  The datagrams of the
+	// matching QUIC flows are discarded whatever the action is.
+	DropActions map[string]drop.Action
+
+	// DropPeriod is the time the dropped connections hang or trickle unless
+	// their action specifies another one.  If zero, 3 minutes are used.
+	DropPeriod time.Duration
+
+	// Faults maps rules to the faults injected into the matching tunnels with
+	// their probabilities.  The faults are evaluated independently and only
+	// the first chosen fault of each kind is injected.
+	Faults map[string][]fault.Fault
+
+	// FaultSeed seeds the random choice of the injected faults, so that the
+	// same sequence of connections matching a fault rule gets the same
+	// faults.  If zero, a random
+	// seed is used and logged.
+	FaultSeed uint64
+
+	// MaxConns is the maximum number of concurrent client connections and QUIC
+	// flows.  If zero, there is no limit.
+	MaxConns int
+
+	// MaxConnsAction is the way the connections over MaxConns are rejected:
+	// BlockResponseClose or BlockResponseRST.
+	MaxConnsAction BlockResponse
+
+	// MaxClientConns is the maximum number of concurrent connections and QUIC
+	// flows from a single client IP address.  If zero, there is no limit.
+	MaxClientConns int
+
+	// MaxClientConnsAction is the way the connections over MaxClientConns are
+	// rejected: BlockResponseClose or BlockResponseRST.
+	MaxClientConnsAction BlockResponse
+
+	// MaxHostConns maps rules to the maximum numbers of concurrent connections
+	// to the hosts that match them.  The connections are counted per rule, so
+	// a wildcard caps all its hosts together.  The dropped connections are
+	// counted until they are closed.
+	MaxHostConns map[string]int
+
+	// MaxHostConnsAction is the way the connections over MaxHostConns are
+	// rejected.
+	MaxHostConnsAction BlockResponse
+
 	// BandwidthRate is a number of bytes per second the connections speed will
 	// be limited to.  If not set, there is no limit.
 	BandwidthRate float64
@@ -40,4 +184,73 @@ type Config struct {
 	// domains that match the wildcards.  Has higher priority than
 	// BandwidthRate.
 	BandwidthRules map[string]float64
+
+	// ReadTimeout is the time the proxy waits for the first bytes of a new
+	// client connection: the ClientHello, the HTTP request headers or the
+	// proxy handshake.  If zero, 10 seconds are used.
+	ReadTimeout time.Duration
+
+	// ReadTimeoutRules maps rules to the read timeouts of the matching
+	// requests in HTTPModeRequest and on the explicit proxy listeners: the
+	// time the client has to send every chunk of the request body and the
+	// rest of the headers of the next request within.  The ClientHello and the
+	// headers of the first request are read before the host is known, so
+	// ReadTimeout always applies to them.
+	ReadTimeoutRules map[string]time.Duration
+
+	// BackendResponseTimeoutRules maps rules to the time the backends of the
+	// matching connections have to send the first bytes of their response,
+	// e.g. the TLS ServerHello.  In HTTPModeRequest and on the explicit proxy
+	// listeners, it limits the wait for the headers of every response.
+	BackendResponseTimeoutRules map[string]time.Duration
+
+	// ConnectTimeout is the timeout for connecting to the backends, including
+	// the handshakes with the upstream proxies.  If zero, 10 seconds are used.
+	ConnectTimeout time.Duration
+
+	// ConnectTimeoutRules maps rules to the connect timeouts of the matching
+	// connections.  Has higher priority than ConnectTimeout.
+	ConnectTimeoutRules map[string]time.Duration
+
+	// TunnelIdleTimeout is the time after which a tunnel is closed if no data
+	// has been transferred in either direction.  If zero, there is no
+	// timeout.
+	TunnelIdleTimeout time.Duration
+
+	// TunnelIdleTimeoutRules maps rules to the idle timeouts of the matching
+	// tunnels.  Has higher priority than TunnelIdleTimeout, zero disables the
+	// timeout.
+	TunnelIdleTimeoutRules map[string]time.Duration
+
+	// TunnelMaxLifetime is the time after which a tunnel is closed regardless
+	// of its activity.  If zero, there is no limit.
+	TunnelMaxLifetime time.Duration
+
+	// TunnelMaxLifetimeRules maps rules to the maximum lifetimes of the
+	// matching tunnels.  Has higher priority than TunnelMaxLifetime, zero
+	// disables the limit.
+	TunnelMaxLifetimeRules map[string]time.Duration
+
+	// KeepAlive is the TCP keepalive period of both sides of the tunnels.  If
+	// zero, the system default is used.  If negative, keepalive is disabled.
+	KeepAlive time.Duration
+
+	// KeepAliveRules maps rules to the TCP keepalive periods of the matching
+	// tunnels.  Has higher priority than KeepAlive.
+	KeepAliveRules map[string]time.Duration
+
+	// HTTPIdleTimeout is the time the proxy waits for the next request on a
+	// keep-alive connection of a listener in HTTPModeRequest.  If zero, 2
+	// minutes are used.
+	HTTPIdleTimeout time.Duration
+
+	// HTTPMaxBackends is the maximum number of backend connections a single
+	// client connection of a listener in HTTPModeRequest keeps.  The least
+	// recently used one is closed to open another one.  If zero, 8 are used.
+	HTTPMaxBackends int
+
+	// DrainTimeout is the time the proxy waits for the active tunnels to
+	// finish when it is being closed.  The tunnels that are still active after
+	// this period are closed forcibly.
+	DrainTimeout time.Duration
 }
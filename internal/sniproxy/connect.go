@@ -0,0 +1,141 @@
+package gorao
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// checkProxyRequest checks the credentials and the form of the request sent
+// to the explicit proxy listener and removes the hop-by-hop proxy headers
+// from it.  If the request is not acceptable, the error response is sent to
+// the client and false is returned.
+func (s *httpSession) checkProxyRequest(req *http.Request) (ok bool) {
+	if !s.authorized(req) {
+		log.Debug("gorao: listener %s: proxy authentication failed for %s", s.l.name, s.clientAddr)
+
+		s.writeStatus(http.StatusProxyAuthRequired, http.Header{
+			"Proxy-Authenticate": {`Basic realm="gorao"`},
+		})
+
+		return false
+	}
+
+	if req.Method != http.MethodConnect && !req.URL.IsAbs() {
+		log.Debug("gorao: listener %s: request from %s is not in absolute form", s.l.name, s.clientAddr)
+
+		s.writeStatus(http.StatusBadRequest, nil)
+
+		return false
+	}
+
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+
+	return true
+}
+
+// authorized returns true if the listener doesn't require authentication or
+// the request has the right Basic credentials.
+func (s *httpSession) authorized(req *http.Request) (ok bool) {
+	if s.l.auth == nil {
+		return true
+	}
+
+	// Reuse the parser of the Authorization header.
+	r := &http.Request{
+		Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")},
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	wantPass, _ := s.l.auth.Password()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.l.auth.Username())) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+
+	return userOK && passOK
+}
+
+// connectTunnel handles the CONNECT request: it connects to the requested
+// host, replies with 200 and tunnels the connection there.
+func (s *httpSession) connectTunnel(req *http.Request) (err error) {
+	p := s.p
+
+	ctx, ok := p.newContext(s.l, s.clientConn, req.Host, s.originalDst)
+	if !ok {
+		s.writeStatus(http.StatusBadRequest, nil)
+
+		return nil
+	}
+
+	log.Info(
+		"gorao: [%d] start tunneling from %s to %s via %s",
+		ctx.ID,
+		ctx.ClientAddr,
+		ctx.RemoteAddr,
+		ctx.Upstream,
+	)
+
+	if _, blocked := p.blocked(ctx); blocked {
+		s.writeStatus(http.StatusForbidden, nil)
+
+		return nil
+	}
+
+	releaseHost, ok := p.admitHost(ctx, s.clientConn, s.l.proto)
+	if !ok {
+		return nil
+	}
+	defer releaseHost()
+
+	if p.dropped(ctx, s.clientConn) {
+		return nil
+	}
+
+	backendConn, err := p.connect(ctx)
+	if err != nil {
+		s.writeStatus(http.StatusBadGateway, nil)
+
+		if errors.Is(err, errLoop) {
+			return nil
+		}
+
+		return err
+	}
+	defer log.OnCloserError(backendConn, log.DEBUG)
+	defer p.untrackConn(backendConn)
+
+	_, err = io.WriteString(s.clientConn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		return fmt.Errorf("gorao: [%d] failed to write response: %w", ctx.ID, err)
+	}
+
+	p.relay(ctx, s.clientConn, s.reader, backendConn)
+
+	return nil
+}
+
+// writeStatus sends the response with the status code, the headers h and no
+// body to the client.  The client connection is expected to be closed after
+// that.
+func (s *httpSession) writeStatus(code int, h http.Header) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Close:      true,
+	}
+
+	err := resp.Write(s.clientConn)
+	if err != nil {
+		log.Debug("gorao: listener %s: failed to write response: %v", s.l.name, err)
+	}
+}
@@ -0,0 +1,91 @@
+package gorao
+
+import (
+	"io"
+	"net"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/zamibd/gorao/internal/drop"
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+// trickleRate is the speed in bytes per second the trickled connections are
+// tunneled at.
+const trickleRate = 16
+
+// trickleReader reads a single byte at a time so that the throttled data of a
+// trickled connection flows byte by byte instead of in bursts.
+type trickleReader struct {
+	r io.Reader
+}
+
+// type check
+var _ io.Reader = trickleReader{}
+
+// Read implements the [io.Reader] interface for trickleReader.
+func (t trickleReader) Read(b []byte) (n int, err error) {
+	return t.r.Read(b[:min(len(b), 1)])
+}
+
+// dropAction returns the way the connection is dropped and true if it matches
+// a drop action or a drop rule.
+func (p *Gorao) dropAction(ctx *SNIContext) (a drop.Action, ok bool) {
+	if a, _, ok = p.dropActions.Match(ctx.target()); ok {
+		return a, true
+	}
+
+	if _, ok = filter.MatchRules(ctx.target(), p.dropRules); ok {
+		return drop.Action{Kind: drop.Hang}, true
+	}
+
+	return drop.Action{}, false
+}
+
+// dropped returns true if the connection matches a drop action or a drop rule
+// and must be closed.  It hangs or resets the client connection according to
+// the action before returning.  Trickled connections aren't closed, they are
+// tunneled slowly for the drop period instead, see SNIContext.Trickle.
+func (p *Gorao) dropped(ctx *SNIContext, clientConn net.Conn) (ok bool) {
+	a, ok := p.dropAction(ctx)
+	if !ok {
+		return false
+	}
+
+	log.Info("gorao: [%d] dropped connection to %s: %s", ctx.ID, ctx.RemoteHost, a)
+
+	switch a.Kind {
+	case drop.Trickle:
+		ctx.Trickle = a.PeriodOr(p.dropPeriod)
+
+		return false
+	case drop.RST:
+		setLingerZero(clientConn)
+	case drop.FIN:
+		// The connection is closed by the caller.
+	default:
+		// Emulate the situation with a connection that was "dropped".
+		p.wait(a.PeriodOr(p.dropPeriod))
+	}
+
+	return true
+}
+
+// linger is implemented by the connections which close can be turned into a
+// reset, e.g. *net.TCPConn.
+type linger interface {
+	SetLinger(sec int) (err error)
+}
+
+// setLingerZero makes closing conn send a TCP RST instead of FIN.
+func setLingerZero(conn net.Conn) {
+	l, ok := conn.(linger)
+	if !ok {
+		log.Debug("gorao: cannot reset %T, closing it", conn)
+
+		return
+	}
+
+	if err := l.SetLinger(0); err != nil {
+		log.Debug("gorao: failed to set linger: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package gorao
+
+import (
+	"encoding/binary"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// extensionECH is the type of the encrypted_client_hello TLS extension.
+	extensionECH = 0xfe0d
+
+	// echClientHelloOuter is the ECHClientHelloType of the outer ClientHello
+	// that carries the encrypted inner one.
+	echClientHelloOuter = 0
+
+	// recordTypeHandshake is the content type of TLS handshake records.
+	recordTypeHandshake = 22
+
+	// handshakeTypeClientHello is the handshake message type of ClientHello.
+	handshakeTypeClientHello = 1
+)
+
+// echInfo is the information about the Encrypted Client Hello extension of a
+// ClientHello.
+type echInfo struct {
+	// configID is the identifier of the ECH configuration the inner
+	// ClientHello was encrypted with.
+	configID uint8
+}
+
+// setECH fills the ECH fields of the context if the ClientHello has the ECH
+// extension, i.e. ech is not nil.  It may be a GREASE extension, see
+// parseECH.
+func setECH(ctx *SNIContext, ech *echInfo) {
+	if ech == nil {
+		return
+	}
+
+	ctx.ECH = true
+	ctx.ECHOuterServerName = ctx.RemoteHost
+	ctx.ECHConfigID = ech.configID
+
+	log.Debug(
+		"gorao: [%d] client hello is encrypted, outer server name %q, ech config id %d",
+		ctx.ID,
+		ctx.ECHOuterServerName,
+		ctx.ECHConfigID,
+	)
+}
+
+// parseECH parses the TLS records that contain a ClientHello and returns the
+// information about its ECH extension.  It returns nil if there is no such
+// extension or the data cannot be parsed.  Note that the clients that don't
+// have an ECH configuration may send a GREASE extension that is
+// indistinguishable from the real one.
+func parseECH(records []byte) (info *echInfo) {
+	hello := handshakeMessage(records)
+	if len(hello) < 4 || hello[0] != handshakeTypeClientHello {
+		return nil
+	}
+
+	// Skip the message header, legacy_version and random.
+	b := skip(hello, 4+2+32)
+
+	// Skip legacy_session_id, cipher_suites and legacy_compression_methods.
+	b = skipVector(b, 1)
+	b = skipVector(b, 2)
+	b = skipVector(b, 1)
+
+	if len(b) < 2 {
+		return nil
+	}
+
+	exts := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n < len(exts) {
+		exts = exts[:n]
+	}
+
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			return nil
+		}
+
+		data := exts[4 : 4+n]
+		exts = exts[4+n:]
+
+		if typ != extensionECH {
+			continue
+		}
+
+		// ECHClientHello: type (1 byte), cipher_suite (4 bytes), config_id
+		// (1 byte), enc and payload.
+		if len(data) < 6 || data[0] != echClientHelloOuter {
+			return nil
+		}
+
+		return &echInfo{
+			configID: data[5],
+		}
+	}
+
+	return nil
+}
+
+// handshakeMessage concatenates the payloads of the handshake records.  The
+// result may be truncated if the records are incomplete.
+func handshakeMessage(records []byte) (msg []byte) {
+	for len(records) >= 5 && records[0] == recordTypeHandshake {
+		n := int(binary.BigEndian.Uint16(records[3:]))
+		records = records[5:]
+		if n > len(records) {
+			n = len(records)
+		}
+
+		msg = append(msg, records[:n]...)
+		records = records[n:]
+	}
+
+	return msg
+}
+
+// skip returns b without the first n bytes or nil if b is too short.
+func skip(b []byte, n int) (res []byte) {
+	if len(b) < n {
+		return nil
+	}
+
+	return b[n:]
+}
+
+// skipVector returns b without the leading vector whose length is encoded in
+// lenSize bytes or nil if b is too short.
+func skipVector(b []byte, lenSize int) (res []byte) {
+	if len(b) < lenSize {
+		return nil
+	}
+
+	n := 0
+	for _, c := range b[:lenSize] {
+		n = n<<8 | int(c)
+	}
+
+	return skip(b, lenSize+n)
+}
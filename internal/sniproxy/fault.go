@@ -0,0 +1,209 @@
+package gorao
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/zamibd/gorao/internal/fault"
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+// errFaultReset is returned when the tunnel is reset by a fault.
+var errFaultReset = errors.New("reset by fault injection")
+
+// faultRule is the list of the faults of a fault rule.
+type faultRule struct {
+	faults []fault.Fault
+
+	// conns is the number of the connections that have matched the rule.  It
+	// seeds the choice of their faults, so that it doesn't depend on the
+	// connections that don't match the rule.
+	conns atomic.Uint64
+}
+
+// newFaultRules creates the fault rules from the faults by rule.
+func newFaultRules(m map[string][]fault.Fault) (rm *filter.RuleMap[*faultRule], err error) {
+	rules := make(map[string]*faultRule, len(m))
+	for k, faults := range m {
+		rules[k] = &faultRule{faults: faults}
+	}
+
+	return filter.NewRuleMap(rules)
+}
+
+// injectFaults chooses the faults injected into the tunnel of ctx from the
+// fault rule that matches it.  The faults are chosen by a random generator
+// seeded with the fault seed and the number of the connection among the ones
+// that have matched the rule, so the same sequence of connections to the
+// matching hosts gets the same faults regardless of the other traffic.
+func (p *Gorao) injectFaults(ctx *SNIContext) {
+	fr, _, ok := p.faultRules.Match(ctx.target())
+	if !ok {
+		return
+	}
+
+	r := rand.New(rand.NewPCG(p.faultSeed, fr.conns.Add(1)))
+
+	ctx.Faults = nil
+	for _, f := range fr.faults {
+		if !f.Roll(r) {
+			continue
+		} else if _, ok = ctx.fault(f.Kind); ok {
+			// Only the first fault of each kind is injected.
+			continue
+		}
+
+		switch f.Kind {
+		case fault.Stall:
+			f.Period = time.Duration(r.Int64N(int64(f.Period))) + 1
+		case fault.Corrupt:
+			f.Bytes = r.Int64N(f.Bytes)
+		}
+
+		ctx.Faults = append(ctx.Faults, f)
+	}
+
+	if len(ctx.Faults) > 0 {
+		log.Info("gorao: [%d] injecting faults into tunnel to %s: %v", ctx.ID, ctx.RemoteHost, ctx.Faults)
+	}
+}
+
+// fault returns the injected fault of the kind and true if there is one.
+func (c *SNIContext) fault(kind fault.Kind) (f fault.Fault, ok bool) {
+	for _, f = range c.Faults {
+		if f.Kind == kind {
+			return f, true
+		}
+	}
+
+	return fault.Fault{}, false
+}
+
+// dialFault returns the error connecting to the backend of ctx fails with if
+// the dial-error fault is injected into it.  timeout is the connect timeout
+// of ctx, the timeout error is returned once it's exceeded.
+func (p *Gorao) dialFault(ctx *SNIContext, timeout time.Duration) (err error) {
+	f, ok := ctx.fault(fault.DialError)
+	if !ok {
+		return nil
+	}
+
+	var errno syscall.Errno
+	switch f.Error {
+	case fault.ErrTimeout:
+		p.wait(timeout)
+
+		return &timeoutError{name: "connect", timeout: timeout, err: os.ErrDeadlineExceeded}
+	case fault.ErrReset:
+		errno = syscall.ECONNRESET
+	case fault.ErrUnreachable:
+		errno = syscall.EHOSTUNREACH
+	default:
+		errno = syscall.ECONNREFUSED
+	}
+
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+// faultReader returns the reader of the response of the tunnel of ctx that
+// injects the response faults into it.  r is returned as is if there are
+// none.
+func (p *Gorao) faultReader(ctx *SNIContext, t *tunnelTimers, r io.Reader) (res io.Reader) {
+	fr := &faultReader{
+		r:          r,
+		p:          p,
+		t:          t,
+		resetAt:    math.MaxInt64,
+		truncateAt: math.MaxInt64,
+		corruptAt:  -1,
+	}
+
+	var ok bool
+	for _, f := range ctx.Faults {
+		switch f.Kind {
+		case fault.ResetBytes:
+			fr.resetAt = f.Bytes
+		case fault.Truncate:
+			fr.truncateAt = f.Bytes
+		case fault.Corrupt:
+			fr.corruptAt = f.Bytes
+		case fault.Stall:
+			fr.stall = f.Period
+		default:
+			continue
+		}
+
+		ok = true
+	}
+
+	if !ok {
+		return r
+	}
+
+	return fr
+}
+
+// faultReader injects the faults into the response read from r.  The offsets
+// are counted in the response bytes, resetAt and truncateAt are
+// math.MaxInt64 and corruptAt is negative if the fault isn't injected.
+type faultReader struct {
+	r io.Reader
+	p *Gorao
+	t *tunnelTimers
+
+	resetAt    int64
+	truncateAt int64
+	corruptAt  int64
+	stall      time.Duration
+
+	read int64
+}
+
+// type check
+var _ io.Reader = (*faultReader)(nil)
+
+// Read implements the [io.Reader] interface for *faultReader.
+func (r *faultReader) Read(b []byte) (n int, err error) {
+	ctx := r.t.ctx
+
+	switch {
+	case r.read >= r.resetAt:
+		r.t.close("reset by fault injection", true)
+
+		return 0, errFaultReset
+	case r.read >= r.truncateAt:
+		log.Debug("gorao: [%d] truncating response after %d bytes", ctx.ID, r.read)
+
+		return 0, io.EOF
+	}
+
+	if rem := min(r.resetAt, r.truncateAt) - r.read; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+
+	n, err = r.r.Read(b)
+	if n > 0 && r.stall > 0 {
+		log.Debug("gorao: [%d] stalling response for %v", ctx.ID, r.stall)
+
+		r.p.wait(r.stall)
+		r.stall = 0
+	}
+
+	if off := r.corruptAt - r.read; off >= 0 && off < int64(n) {
+		log.Debug("gorao: [%d] corrupting response byte %d", ctx.ID, r.corruptAt)
+
+		b[off] ^= 0xff
+	}
+
+	r.read += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,74 @@
+package gorao
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zamibd/gorao/internal/fault"
+)
+
+func TestGorao_injectFaults(t *testing.T) {
+	const n = 200
+
+	// run returns the faults injected into n connections to the faulty host
+	// with other connections between them, the ones that match the other
+	// fault rule and the ones that match none.
+	run := func(t *testing.T, other int) (injected [][]fault.Fault) {
+		t.Helper()
+
+		p, err := New(&Config{
+			Faults: map[string][]fault.Fault{
+				"faulty.example": {
+					{Kind: fault.Stall, Period: time.Second, Percent: 50},
+					{Kind: fault.Truncate, Bytes: 100, Percent: 50},
+					{Kind: fault.Corrupt, Bytes: 1024, Percent: 50},
+				},
+				"other.example": {
+					{Kind: fault.ResetBytes, Bytes: 10, Percent: 50},
+				},
+			},
+			FaultSeed: 42,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var id uint64
+		for range n {
+			for _, host := range slices.Repeat([]string{"other.example", "clean.example"}, other) {
+				id++
+				p.injectFaults(&SNIContext{ID: id, RemoteHost: host})
+			}
+
+			id++
+			ctx := &SNIContext{ID: id, RemoteHost: "faulty.example"}
+			p.injectFaults(ctx)
+			injected = append(injected, ctx.Faults)
+		}
+
+		return injected
+	}
+
+	want := run(t, 0)
+
+	var withFaults int
+	for _, faults := range want {
+		if len(faults) > 0 {
+			withFaults++
+		}
+	}
+
+	if withFaults == 0 || withFaults == n {
+		t.Fatalf("faults are injected into %d connections out of %d", withFaults, n)
+	}
+
+	for _, other := range []int{1, 3} {
+		got := run(t, other)
+		for i := range want {
+			if !slices.Equal(got[i], want[i]) {
+				t.Fatalf("%d other connections between: connection %d: got %v, want %v", other, i, got[i], want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package gorao
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// h2cPrefix is the beginning of the HTTP/2 connection preface.  It is
+	// enough to tell the preface from an HTTP/1.x request line.
+	h2cPrefix = "PRI"
+
+	// h2cMaxFrames is the maximum number of frames read before the first
+	// HEADERS frame.  The clients usually send SETTINGS and WINDOW_UPDATE
+	// frames only.
+	h2cMaxFrames = 10
+
+	// h2cMaxHeaderListSize is the maximum size of the decoded header list of
+	// the first request.
+	h2cMaxHeaderListSize = 64 * 1024
+)
+
+// isH2C returns true if the data in the reader starts with the HTTP/2
+// connection preface, i.e. the client uses HTTP/2 with prior knowledge.
+func isH2C(reader *bufio.Reader) (ok bool) {
+	b, err := reader.Peek(len(h2cPrefix))
+
+	return err == nil && string(b) == h2cPrefix
+}
+
+// readH2CAuthority reads the HTTP/2 connection preface and the frames up to
+// the first HEADERS frame and its CONTINUATION frames, and returns the
+// :authority pseudo-header of the request or its Host header.
+func readH2CAuthority(reader io.Reader) (host string, err error) {
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err = io.ReadFull(reader, preface); err != nil {
+		return "", fmt.Errorf("gorao: failed to read http/2 preface: %w", err)
+	}
+
+	if !bytes.Equal(preface, []byte(http2.ClientPreface)) {
+		return "", fmt.Errorf("gorao: bad http/2 preface %q", preface)
+	}
+
+	framer := http2.NewFramer(io.Discard, reader)
+	framer.MaxHeaderListSize = h2cMaxHeaderListSize
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	for range h2cMaxFrames {
+		var f http2.Frame
+		f, err = framer.ReadFrame()
+		if err != nil {
+			return "", fmt.Errorf("gorao: failed to read http/2 frame: %w", err)
+		}
+
+		headers, ok := f.(*http2.MetaHeadersFrame)
+		if !ok {
+			continue
+		}
+
+		host = headers.PseudoValue("authority")
+		if host == "" {
+			for _, hf := range headers.RegularFields() {
+				if hf.Name == "host" {
+					host = hf.Value
+
+					break
+				}
+			}
+		}
+
+		return host, nil
+	}
+
+	return "", fmt.Errorf("gorao: no http/2 headers in the first %d frames", h2cMaxFrames)
+}
@@ -0,0 +1,555 @@
+package gorao
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/zamibd/gorao/internal/shapeio"
+)
+
+// HTTPMode defines how a plain HTTP listener handles the requests of a single
+// connection.
+type HTTPMode string
+
+const (
+	// HTTPModeTunnel means that the Host header of the first request chooses
+	// the backend and the connection is tunneled there as is.
+	HTTPModeTunnel HTTPMode = ""
+
+	// HTTPModeRequest means that every request on the connection is parsed
+	// and the rules are applied to it separately, so that the requests to
+	// different hosts go to different backends.
+	HTTPModeRequest HTTPMode = "request"
+)
+
+// ParseHTTPMode parses the HTTP mode from its string representation.
+// "tunnel" and an empty string are both mapped to HTTPModeTunnel.
+func ParseHTTPMode(s string) (m HTTPMode, err error) {
+	switch m = HTTPMode(s); m {
+	case HTTPModeTunnel, HTTPModeRequest:
+		return m, nil
+	case "tunnel":
+		return HTTPModeTunnel, nil
+	default:
+		return "", fmt.Errorf("gorao: unsupported http mode %q", s)
+	}
+}
+
+// httpBackend is a backend connection that serves the requests to a single
+// host.
+type httpBackend struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// releaseHost releases the slot of the host cap the backend connection
+	// holds until it's closed.
+	releaseHost func()
+
+	// lastUsed is the time of the last request sent to the backend.  The
+	// least recently used backend is closed first, see httpSession.backend.
+	lastUsed time.Time
+}
+
+// httpSession is the state of a client connection in HTTPModeRequest or on an
+// explicit proxy listener.
+type httpSession struct {
+	p           *Gorao
+	l           *listener
+	clientConn  net.Conn
+	clientAddr  netip.AddrPort
+	reader      *bufio.Reader
+	originalDst netip.AddrPort
+
+	// backends are the backend connections by upstream and remote address.
+	backends map[string]*httpBackend
+
+	// idleTimeout is the time the proxy waits for the next request.  It's
+	// the idle timeout of the tunnel of the last request if it's shorter than
+	// Gorao.httpIdleTimeout.
+	idleTimeout time.Duration
+
+	// readTimeout is the read timeout of the last request, see
+	// Gorao.requestReadTimeout.  Once the next request starts, the rest of its
+	// headers must be received within it.  Zero means no timeout.
+	readTimeout time.Duration
+}
+
+// serveHTTPRequests handles the requests of the plain HTTP connection one by
+// one, applies the rules to every request and sends it to the backend chosen
+// for its Host header.  A request with the Upgrade header switches the
+// connection to tunneling, and so does a CONNECT request on the explicit proxy
+// listeners.
+func (p *Gorao) serveHTTPRequests(
+	clientConn net.Conn,
+	reader *bufio.Reader,
+	l *listener,
+	originalDst netip.AddrPort,
+) (err error) {
+	s := &httpSession{
+		p:           p,
+		l:           l,
+		clientConn:  clientConn,
+		clientAddr:  netutil.NetAddrToAddrPort(clientConn.RemoteAddr()),
+		reader:      reader,
+		originalDst: originalDst,
+		backends:    map[string]*httpBackend{},
+	}
+	defer s.closeBackends()
+
+	timeout, timeoutName := p.readTimeout, "read"
+	for {
+		if err = clientConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("gorao: failed to set read deadline: %w", err)
+		}
+
+		if s.readTimeout > 0 {
+			timeout, timeoutName, err = s.waitRequest(timeout, timeoutName)
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		var req *http.Request
+		req, err = http.ReadRequest(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			err = nameTimeout(err, timeoutName, timeout)
+
+			return fmt.Errorf("gorao: failed to read http request: %w", err)
+		}
+
+		if err = clientConn.SetReadDeadline(time.Time{}); err != nil {
+			return fmt.Errorf("gorao: failed to remove read deadline: %w", err)
+		}
+
+		var keepAlive bool
+		keepAlive, err = s.handleRequest(req)
+		if err != nil || !keepAlive {
+			return err
+		}
+
+		timeout, timeoutName = s.idleTimeout, "idle"
+	}
+}
+
+// waitRequest waits for the first bytes of the next request within timeout and
+// sets the read deadline for the rest of it to the read timeout of the last
+// request.  It returns the new timeout and its name.
+func (s *httpSession) waitRequest(
+	timeout time.Duration,
+	timeoutName string,
+) (next time.Duration, nextName string, err error) {
+	_, err = s.reader.Peek(1)
+	if errors.Is(err, io.EOF) {
+		return 0, "", err
+	} else if err != nil {
+		err = nameTimeout(err, timeoutName, timeout)
+
+		return 0, "", fmt.Errorf("gorao: failed to read http request: %w", err)
+	}
+
+	if err = s.clientConn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+		return 0, "", fmt.Errorf("gorao: failed to set read deadline: %w", err)
+	}
+
+	return s.readTimeout, "read", nil
+}
+
+// handleRequest applies the rules to the request and sends it to the backend.
+// It returns false if the client connection must be closed.
+func (s *httpSession) handleRequest(req *http.Request) (keepAlive bool, err error) {
+	p := s.p
+
+	if s.l.proto == ProtocolConnect {
+		if !s.checkProxyRequest(req) {
+			return false, nil
+		}
+
+		if req.Method == http.MethodConnect {
+			return false, s.connectTunnel(req)
+		}
+	}
+
+	ctx, ok := p.newContext(s.l, s.clientConn, req.Host, s.originalDst)
+	if !ok {
+		return false, nil
+	}
+
+	s.idleTimeout = p.httpIdleTimeout
+	if idle, _, _ := p.tunnelLimits(ctx); idle > 0 {
+		s.idleTimeout = min(s.idleTimeout, idle)
+	}
+
+	s.readTimeout, _ = p.requestReadTimeout(ctx)
+
+	log.Info(
+		"gorao: [%d] forwarding %s %s from %s to %s via %s",
+		ctx.ID,
+		req.Method,
+		req.URL.Redacted(),
+		ctx.ClientAddr,
+		ctx.RemoteAddr,
+		ctx.Upstream,
+	)
+
+	if rule, blocked := p.blocked(ctx); blocked {
+		if s.l.proto == ProtocolConnect && p.blockPage == nil {
+			s.writeStatus(http.StatusForbidden, nil)
+		} else {
+			p.reject(ctx, s.clientConn, ProtocolHTTP, rule)
+		}
+
+		return false, nil
+	}
+
+	key := s.backendKey(ctx)
+	_, reused := s.backends[key]
+
+	// A new backend connection holds a slot of the host cap until it's
+	// closed, the reused one already has it.
+	releaseHost := func() {}
+	if !reused {
+		releaseHost, ok = p.admitHost(ctx, s.clientConn, s.l.proto)
+		if !ok {
+			return false, nil
+		}
+	}
+
+	if p.dropped(ctx, s.clientConn) {
+		releaseHost()
+
+		return false, nil
+	}
+
+	if reused {
+		// Connecting to a new backend chooses the faults of the request
+		// itself, see Gorao.connect.
+		p.injectFaults(ctx)
+	}
+
+	// Don't let the request writer add its own User-Agent.
+	if _, ok = req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = nil
+	}
+
+	if s.readTimeout > 0 {
+		req.Body = readTimeoutBody(s.clientConn, req.Body, s.readTimeout)
+	}
+
+	resp, b, timers, err := s.roundTrip(ctx, req, releaseHost)
+	if err != nil {
+		return false, err
+	}
+	defer timers.stop()
+
+	if s.readTimeout > 0 {
+		// The request body has been sent, don't let its deadline fire later.
+		if err = s.clientConn.SetReadDeadline(time.Time{}); err != nil {
+			return false, fmt.Errorf("gorao: [%d] failed to remove read deadline: %w", ctx.ID, err)
+		}
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return false, s.upgrade(ctx, resp, b, timers)
+	}
+
+	writer := shapeio.NewWriter(s.clientConn, p.limiter)
+	if v, ok := p.rateLimit(ctx); ok {
+		writer.SetRateLimit(v)
+	}
+
+	resp.Body = timedBody(timers, resp.Body)
+	complete, err := s.writeResponse(ctx, resp, timers, writer)
+	if err != nil {
+		return false, fmt.Errorf("gorao: [%d] failed to write response: %w", ctx.ID, err)
+	} else if !complete {
+		// The rest of the response is still in the backend connection.
+		s.closeBackend(key)
+
+		return false, nil
+	}
+
+	log.Debug("gorao: [%d] finished request with status %d", ctx.ID, resp.StatusCode)
+
+	if resp.Close {
+		s.closeBackend(key)
+	}
+
+	return !resp.Close && !req.Close, nil
+}
+
+// roundTrip sends the request to the backend of ctx and reads the response
+// headers.  Informational responses other than 101 are passed to the client
+// as they come.  The request without body is retried once if the reused
+// backend connection turns out to be closed.  releaseHost is passed to
+// backend.  The exchange is limited by the tunnel timers of ctx the same way
+// a tunnel is, the caller must stop them once the response is written.
+func (s *httpSession) roundTrip(
+	ctx *SNIContext,
+	req *http.Request,
+	releaseHost func(),
+) (resp *http.Response, b *httpBackend, timers *tunnelTimers, err error) {
+	key := s.backendKey(ctx)
+	_, reused := s.backends[key]
+
+	b, err = s.backend(ctx, releaseHost)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	timers = s.p.startTimers(ctx, s.clientConn, b.conn)
+	resp, err = s.send(ctx, b, req, timers)
+	if err != nil && reused && req.Body == http.NoBody && !errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Debug("gorao: [%d] retrying request on a new connection: %v", ctx.ID, err)
+
+		timers.stop()
+		if err = s.redial(ctx, key); err != nil {
+			return nil, nil, nil, err
+		}
+
+		timers = s.p.startTimers(ctx, s.clientConn, b.conn)
+		resp, err = s.send(ctx, b, req, timers)
+	}
+
+	if err != nil {
+		timers.stop()
+		s.closeBackend(key)
+
+		return nil, nil, nil, fmt.Errorf("gorao: [%d] request to %s: %w", ctx.ID, ctx.RemoteAddr, err)
+	}
+
+	return resp, b, timers, nil
+}
+
+// send writes the request to the backend of ctx and reads the response
+// headers.  Reading the request body and the response headers marks the
+// exchange as active for timers.  If a backend response timeout rule matches
+// ctx, the response headers must be received within that timeout.
+func (s *httpSession) send(
+	ctx *SNIContext,
+	b *httpBackend,
+	req *http.Request,
+	timers *tunnelTimers,
+) (resp *http.Response, err error) {
+	req.Body = timedBody(timers, req.Body)
+	if err = req.Write(b.conn); err != nil {
+		return nil, err
+	}
+
+	timeout, hasTimeout := s.p.backendResponseTimeout(ctx)
+	if hasTimeout {
+		if err = b.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, fmt.Errorf("failed to set read deadline: %w", err)
+		}
+	}
+
+	for {
+		resp, err = http.ReadResponse(b.reader, req)
+		if err != nil {
+			return nil, nameTimeout(err, "backend response", timeout)
+		}
+
+		timers.touch()
+
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+
+		if err = resp.Write(s.clientConn); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasTimeout {
+		if err = b.conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, fmt.Errorf("failed to remove read deadline: %w", err)
+		}
+	}
+
+	return resp, nil
+}
+
+// writeResponse writes the response to w.  The response faults of ctx are
+// injected into the response bytes the same way as into the response of a
+// tunnel, see Gorao.faultReader.  complete is false if a fault has cut the
+// response short, the client connection must be closed then.
+func (s *httpSession) writeResponse(
+	ctx *SNIContext,
+	resp *http.Response,
+	timers *tunnelTimers,
+	w io.Writer,
+) (complete bool, err error) {
+	pr, pw := io.Pipe()
+	r := s.p.faultReader(ctx, timers, pr)
+	if r == io.Reader(pr) {
+		return true, resp.Write(w)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		wErr := resp.Write(pw)
+		_ = pw.CloseWithError(wErr)
+		done <- wErr
+	}()
+
+	_, err = io.Copy(w, r)
+
+	// Unblock resp.Write if the response has been cut short.
+	_ = pr.Close()
+
+	return <-done == nil, err
+}
+
+// upgrade sends the 101 response to the client and tunnels the connection to
+// the backend that has accepted the upgrade.  The tunnel is limited by the
+// timers of the exchange that has upgraded it.
+func (s *httpSession) upgrade(
+	ctx *SNIContext,
+	resp *http.Response,
+	b *httpBackend,
+	timers *tunnelTimers,
+) (err error) {
+	// The backend connection now belongs to the tunnel.
+	delete(s.backends, s.backendKey(ctx))
+	defer b.releaseHost()
+	defer log.OnCloserError(b.conn, log.DEBUG)
+	defer s.p.untrackConn(b.conn)
+
+	if err = resp.Write(s.clientConn); err != nil {
+		return fmt.Errorf("gorao: [%d] failed to write response: %w", ctx.ID, err)
+	}
+
+	log.Info("gorao: [%d] upgraded to %s, tunneling to %s", ctx.ID, resp.Header.Get("Upgrade"), ctx.RemoteAddr)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		s.p.tunnel(ctx, s.clientConn, timers.reader(s.p.faultReader(ctx, timers, b.reader)))
+	}()
+
+	s.p.tunnel(ctx, b.conn, timers.reader(s.reader))
+	<-done
+
+	return nil
+}
+
+// timedBody returns the body that marks the exchange as active for timers on
+// every read.  http.NoBody is returned as is.
+func timedBody(timers *tunnelTimers, body io.ReadCloser) (res io.ReadCloser) {
+	if body == http.NoBody {
+		return body
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: timers.reader(body),
+		Closer: body,
+	}
+}
+
+// backendKey returns the key of the backend connection of ctx.
+func (s *httpSession) backendKey(ctx *SNIContext) (key string) {
+	return ctx.Upstream + " " + ctx.RemoteAddr
+}
+
+// backend returns the backend connection for ctx, connecting to it if there
+// is none yet.  The new backend connection takes over releaseHost, which is
+// called right away if connecting fails.
+func (s *httpSession) backend(ctx *SNIContext, releaseHost func()) (b *httpBackend, err error) {
+	key := s.backendKey(ctx)
+	if b = s.backends[key]; b != nil {
+		b.lastUsed = time.Now()
+
+		return b, nil
+	}
+
+	if len(s.backends) >= s.p.httpMaxBackends {
+		s.closeBackend(s.leastRecentlyUsed())
+	}
+
+	conn, err := s.p.connect(ctx)
+	if err != nil {
+		releaseHost()
+
+		return nil, err
+	}
+
+	b = &httpBackend{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		releaseHost: releaseHost,
+		lastUsed:    time.Now(),
+	}
+	s.backends[key] = b
+
+	return b, nil
+}
+
+// redial replaces the connection of the backend with the key with a new one.
+// The backend keeps its slot of the host cap, it's closed if connecting
+// fails.
+func (s *httpSession) redial(ctx *SNIContext, key string) (err error) {
+	b := s.backends[key]
+	s.p.untrackConn(b.conn)
+	log.OnCloserError(b.conn, log.DEBUG)
+
+	conn, err := s.p.connect(ctx)
+	if err != nil {
+		delete(s.backends, key)
+		b.releaseHost()
+
+		return err
+	}
+
+	b.conn, b.reader = conn, bufio.NewReader(conn)
+
+	return nil
+}
+
+// leastRecentlyUsed returns the key of the backend connection the last request
+// has been sent to before the others.
+func (s *httpSession) leastRecentlyUsed() (key string) {
+	var oldest time.Time
+	for k, b := range s.backends {
+		if key == "" || b.lastUsed.Before(oldest) {
+			key, oldest = k, b.lastUsed
+		}
+	}
+
+	return key
+}
+
+// closeBackend closes the backend connection with the key if there is one.
+func (s *httpSession) closeBackend(key string) {
+	b, ok := s.backends[key]
+	if !ok {
+		return
+	}
+
+	delete(s.backends, key)
+	s.p.untrackConn(b.conn)
+	log.OnCloserError(b.conn, log.DEBUG)
+	b.releaseHost()
+}
+
+// closeBackends closes all backend connections of the session.
+func (s *httpSession) closeBackends() {
+	for key := range s.backends {
+		s.closeBackend(key)
+	}
+}
@@ -0,0 +1,279 @@
+package gorao
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+// connLimits counts the concurrent connections and checks them against the
+// configured caps.  A zero cap means no limit.
+type connLimits struct {
+	// hostRules maps rules to the caps of the connections to the hosts that
+	// match them.  The connections are counted per rule, so that a wildcard
+	// caps all its hosts together.
+	hostRules *filter.RuleMap[int]
+
+	// mu protects the counters below.
+	mu      sync.Mutex
+	total   int
+	clients map[netip.Addr]int
+	hosts   map[string]int
+
+	maxTotal  int
+	maxClient int
+
+	totalAction  BlockResponse
+	clientAction BlockResponse
+	hostAction   BlockResponse
+}
+
+// newConnLimits creates the connection limits from the configuration.
+func newConnLimits(cfg *Config) (c *connLimits, err error) {
+	c = &connLimits{
+		clients:      map[netip.Addr]int{},
+		hosts:        map[string]int{},
+		maxTotal:     cfg.MaxConns,
+		maxClient:    cfg.MaxClientConns,
+		totalAction:  cfg.MaxConnsAction,
+		clientAction: cfg.MaxClientConnsAction,
+		hostAction:   cfg.MaxHostConnsAction,
+	}
+
+	// The total and per-client caps are checked before anything is read from
+	// the client, so there is no ClientHello to respond to with an alert.
+	for _, a := range []BlockResponse{c.totalAction, c.clientAction} {
+		if _, isAlert := a.alert(); isAlert {
+			return nil, fmt.Errorf("gorao: connection limit action %q requires a server name", a)
+		}
+	}
+
+	for rule, limit := range cfg.MaxHostConns {
+		if limit <= 0 {
+			return nil, fmt.Errorf("gorao: max host conns: bad limit %d for %q", limit, rule)
+		}
+	}
+
+	c.hostRules, err = filter.NewRuleMap(cfg.MaxHostConns)
+	if err != nil {
+		return nil, fmt.Errorf("gorao: max host conns: %w", err)
+	}
+
+	return c, nil
+}
+
+// acquireTotal reserves a slot for a new connection.  It returns false if the
+// total cap is reached.
+func (c *connLimits) acquireTotal() (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxTotal > 0 && c.total >= c.maxTotal {
+		return false
+	}
+
+	c.total++
+
+	return true
+}
+
+// releaseTotal frees the slot reserved with acquireTotal.
+func (c *connLimits) releaseTotal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+}
+
+// acquireClient reserves a slot for a new connection from addr.  It returns
+// false if the per-client cap is reached.
+func (c *connLimits) acquireClient(addr netip.Addr) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxClient > 0 && c.clients[addr] >= c.maxClient {
+		return false
+	}
+
+	c.clients[addr]++
+
+	return true
+}
+
+// releaseClient frees the slot reserved with acquireClient.
+func (c *connLimits) releaseClient(addr netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clients[addr]--; c.clients[addr] <= 0 {
+		delete(c.clients, addr)
+	}
+}
+
+// acquireHost reserves a slot for a new connection of ctx.  key is the rule
+// the connection is counted by, it is empty if no rule matches.  It returns
+// false if the cap of the rule is reached.
+func (c *connLimits) acquireHost(ctx *SNIContext) (key string, ok bool) {
+	limit, rule, ok := c.hostRules.Match(ctx.target())
+	if !ok {
+		return "", true
+	}
+
+	key = rule.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hosts[key] >= limit {
+		return key, false
+	}
+
+	c.hosts[key]++
+
+	return key, true
+}
+
+// releaseHost frees the slot reserved with acquireHost.
+func (c *connLimits) releaseHost(key string) {
+	if key == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hosts[key]--; c.hosts[key] <= 0 {
+		delete(c.hosts, key)
+	}
+}
+
+// admit reserves a slot for the connection accepted by l.  If the total cap
+// is reached, the connection is rejected and closed.  The caller must call
+// p.limits.releaseTotal once the connection is closed if ok is true.
+func (p *Gorao) admit(conn net.Conn, l *listener) (ok bool) {
+	if p.limits.acquireTotal() {
+		return true
+	}
+
+	log.Debug(
+		"gorao: listener %s: rejected connection from %s: too many connections (%d so far)",
+		l.name,
+		conn.RemoteAddr(),
+		p.counters.limitedTotal.Add(1),
+	)
+
+	rejectLimited(conn, p.limits.totalAction)
+	log.OnCloserError(conn, log.DEBUG)
+
+	return false
+}
+
+// admitClient reserves a slot for the connection from clientAddr.  If the
+// per-client cap is reached, the connection is rejected and ok is false, the
+// caller must close it then.  Otherwise, the caller must call release once
+// the connection is closed.
+func (p *Gorao) admitClient(
+	conn net.Conn,
+	l *listener,
+	clientAddr netip.AddrPort,
+) (release func(), ok bool) {
+	addr := clientAddr.Addr().Unmap()
+	if p.limits.acquireClient(addr) {
+		return func() { p.limits.releaseClient(addr) }, true
+	}
+
+	log.Debug(
+		"gorao: listener %s: rejected connection from %s: too many connections from the client (%d so far)",
+		l.name,
+		clientAddr,
+		p.counters.limitedClient.Add(1),
+	)
+
+	rejectLimited(conn, p.limits.clientAction)
+
+	return nil, false
+}
+
+// admitHost reserves a slot for the connection of ctx accepted with the
+// protocol.  If the cap of the matching host rule is reached, the connection
+// is rejected and ok is false, the caller must close it then.  Otherwise, the
+// caller must call release once the connection is closed.  conn is nil for
+// QUIC flows.
+func (p *Gorao) admitHost(
+	ctx *SNIContext,
+	conn net.Conn,
+	proto Protocol,
+) (release func(), ok bool) {
+	key, ok := p.limits.acquireHost(ctx)
+	if ok {
+		return func() { p.limits.releaseHost(key) }, true
+	}
+
+	log.Info(
+		"gorao: [%d] rejected connection to %s: too many connections for %s (%d so far)",
+		ctx.ID,
+		ctx.RemoteHost,
+		key,
+		p.counters.limitedHost.Add(1),
+	)
+
+	if desc, isAlert := p.limits.hostAction.alert(); isAlert {
+		if proto == ProtocolTLS {
+			writeAlert(ctx, conn, desc)
+		}
+	} else if conn != nil {
+		rejectLimited(conn, p.limits.hostAction)
+	}
+
+	return nil, false
+}
+
+// admitFlow reserves the slots of the total and the per-client caps for the
+// new QUIC flow from addr received by l.  The datagrams of the flow are
+// ignored if ok is false.  Otherwise, the caller must call release once the
+// flow is removed.  The host cap is checked once the server name is known,
+// see admitHost.
+func (p *Gorao) admitFlow(l *listener, addr netip.AddrPort) (release func(), ok bool) {
+	if !p.limits.acquireTotal() {
+		log.Debug(
+			"gorao: listener %s: ignored quic flow from %s: too many connections (%d so far)",
+			l.name,
+			addr,
+			p.counters.limitedTotal.Add(1),
+		)
+
+		return nil, false
+	}
+
+	clientAddr := addr.Addr().Unmap()
+	if !p.limits.acquireClient(clientAddr) {
+		p.limits.releaseTotal()
+
+		log.Debug(
+			"gorao: listener %s: ignored quic flow from %s: too many connections from the client (%d so far)",
+			l.name,
+			addr,
+			p.counters.limitedClient.Add(1),
+		)
+
+		return nil, false
+	}
+
+	return func() {
+		p.limits.releaseClient(clientAddr)
+		p.limits.releaseTotal()
+	}, true
+}
+
+// rejectLimited applies the action to the connection rejected by a cap.  Only
+// BlockResponseRST changes anything, the connection is closed by the caller
+// anyway.
+func rejectLimited(conn net.Conn, action BlockResponse) {
+	if action == BlockResponseRST {
+		setLingerZero(conn)
+	}
+}
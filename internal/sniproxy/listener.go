@@ -0,0 +1,263 @@
+package gorao
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+// Protocol is the protocol of the connections a listener accepts.
+type Protocol string
+
+const (
+	// ProtocolTLS means that the server name is read from the SNI field of
+	// the TLS ClientHello.
+	ProtocolTLS Protocol = "tls"
+
+	// ProtocolHTTP means that the server name is read from the Host header of
+	// the plain HTTP request.
+	ProtocolHTTP Protocol = "http"
+
+	// ProtocolQUIC means that the listener accepts UDP datagrams and the
+	// server name is read from the TLS ClientHello in the QUIC Initial
+	// packets.
+	ProtocolQUIC Protocol = "quic"
+
+	// ProtocolConnect means that the listener is an explicit HTTP proxy and
+	// the server name is read from CONNECT and absolute-form requests.
+	ProtocolConnect Protocol = "connect"
+
+	// ProtocolSOCKS5 means that the listener is a SOCKS5 proxy and the server
+	// name is read from the CONNECT requests.
+	ProtocolSOCKS5 Protocol = "socks5"
+)
+
+// ParseProtocol parses the listener protocol from its string representation.
+func ParseProtocol(s string) (proto Protocol, err error) {
+	switch proto = Protocol(s); proto {
+	case ProtocolTLS, ProtocolHTTP, ProtocolQUIC, ProtocolConnect, ProtocolSOCKS5:
+		return proto, nil
+	default:
+		return "", fmt.Errorf("gorao: unsupported listener protocol %q", s)
+	}
+}
+
+// defaultPort returns the port the connections accepted with this protocol
+// are tunneled to if the client hasn't specified it.
+func (proto Protocol) defaultPort() (port uint16) {
+	if proto == ProtocolHTTP || proto == ProtocolConnect {
+		return remotePortPlain
+	}
+
+	return remotePortTLS
+}
+
+// TransparentMode defines how a listener recovers the original destination of
+// the connections redirected to it by the firewall.
+type TransparentMode string
+
+const (
+	// TransparentOff means that the listener only accepts the connections
+	// addressed to it.
+	TransparentOff TransparentMode = ""
+
+	// TransparentRedirect means that the connections are redirected by an
+	// iptables REDIRECT or DNAT rule and the original destination is read
+	// with SO_ORIGINAL_DST.
+	TransparentRedirect TransparentMode = "redirect"
+
+	// TransparentTProxy means that the connections are redirected by an
+	// iptables TPROXY rule and the original destination is the local address
+	// of the connection.
+	TransparentTProxy TransparentMode = "tproxy"
+)
+
+// ParseTransparentMode parses the transparent mode from its string
+// representation.  "off" and an empty string are both mapped to
+// TransparentOff.
+func ParseTransparentMode(s string) (m TransparentMode, err error) {
+	switch m = TransparentMode(s); m {
+	case TransparentOff, TransparentRedirect, TransparentTProxy:
+		return m, nil
+	case "off":
+		return TransparentOff, nil
+	default:
+		return "", fmt.Errorf("gorao: unsupported transparent mode %q", s)
+	}
+}
+
+// ListenerConfig is the configuration of a single listener.
+type ListenerConfig struct {
+	// Name is the name of the listener.  It is used in the logs and the rules
+	// can match it.
+	Name string
+
+	// Proto is the protocol of the connections the listener accepts.
+	Proto Protocol
+
+	// Addr is the address the listener listens to.
+	Addr *net.TCPAddr
+
+	// DestPort is the port the connections are tunneled to unless the client
+	// specifies it explicitly.  If zero, the default port of Proto is used.
+	DestPort uint16
+
+	// ProxyProtocol defines how the listener handles PROXY protocol headers.
+	ProxyProtocol ProxyProtocolMode
+
+	// ClientFilter is the access control list of the listener.  If nil, all
+	// clients are allowed.
+	ClientFilter *filter.ClientFilter
+
+	// Transparent defines how the listener recovers the original destination
+	// of the connections.  It is only supported on Linux.
+	Transparent TransparentMode
+
+	// HTTPMode defines how the requests of a single connection are handled.
+	// It is only supported for ProtocolHTTP.
+	HTTPMode HTTPMode
+
+	// Auth are the credentials the clients of the explicit proxy listeners
+	// must authenticate with.  If nil, no authentication is required.
+	Auth *url.Userinfo
+}
+
+// listener is a running listener.
+type listener struct {
+	// Listener accepts the TCP connections.  It is nil for QUIC listeners.
+	net.Listener
+
+	// packetConn receives the UDP datagrams of QUIC listeners.
+	packetConn *net.UDPConn
+
+	name          string
+	proto         Protocol
+	addr          *net.TCPAddr
+	destPort      uint16
+	proxyProtocol ProxyProtocolMode
+	clientFilter  *filter.ClientFilter
+	transparent   TransparentMode
+	httpMode      HTTPMode
+	auth          *url.Userinfo
+}
+
+// newListeners creates the listeners from the configuration and checks that
+// their names are unique.  trusted are the networks allowed to send PROXY
+// protocol headers, they are required by the listeners that parse them.
+func newListeners(
+	confs []*ListenerConfig,
+	trusted []netip.Prefix,
+) (listeners []*listener, err error) {
+	names := map[string]struct{}{}
+	for _, c := range confs {
+		if _, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("gorao: duplicate listener name %q", c.Name)
+		}
+
+		names[c.Name] = struct{}{}
+
+		if c.Proto == ProtocolQUIC && (c.ProxyProtocol != ProxyProtocolOff || c.Transparent != TransparentOff) {
+			return nil, fmt.Errorf(
+				"gorao: listener %s: proxy protocol and transparent mode are not supported for quic",
+				c.Name,
+			)
+		}
+
+		if c.ProxyProtocol != ProxyProtocolOff && len(trusted) == 0 {
+			return nil, fmt.Errorf(
+				"gorao: listener %s: proxy protocol requires trusted proxy networks",
+				c.Name,
+			)
+		}
+
+		if c.HTTPMode != HTTPModeTunnel && c.Proto != ProtocolHTTP {
+			return nil, fmt.Errorf("gorao: listener %s: http mode is only supported for http", c.Name)
+		}
+
+		if c.Auth != nil && c.Proto != ProtocolConnect && c.Proto != ProtocolSOCKS5 {
+			return nil, fmt.Errorf("gorao: listener %s: auth is not supported for %s", c.Name, c.Proto)
+		}
+
+		destPort := c.DestPort
+		if destPort == 0 {
+			destPort = c.Proto.defaultPort()
+		}
+
+		listeners = append(listeners, &listener{
+			name:          c.Name,
+			proto:         c.Proto,
+			addr:          c.Addr,
+			destPort:      destPort,
+			proxyProtocol: c.ProxyProtocol,
+			clientFilter:  c.ClientFilter,
+			transparent:   c.Transparent,
+			httpMode:      c.HTTPMode,
+			auth:          c.Auth,
+		})
+	}
+
+	return listeners, nil
+}
+
+// listen starts listening to the configured address.
+func (l *listener) listen() (err error) {
+	if l.proto == ProtocolQUIC {
+		udpAddr := &net.UDPAddr{IP: l.addr.IP, Port: l.addr.Port, Zone: l.addr.Zone}
+		l.packetConn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return fmt.Errorf("gorao: listener %s: %w", l.name, err)
+		}
+
+		return nil
+	}
+
+	lc := &net.ListenConfig{}
+	if l.transparent == TransparentTProxy {
+		lc.Control = setTransparent
+	}
+
+	l.Listener, err = lc.Listen(context.Background(), "tcp", l.addr.String())
+	if err != nil {
+		return fmt.Errorf("gorao: listener %s: %w", l.name, err)
+	}
+
+	return nil
+}
+
+// localAddr returns the address the listener listens to.
+func (l *listener) localAddr() (addr net.Addr) {
+	if l.packetConn != nil {
+		return l.packetConn.LocalAddr()
+	}
+
+	return l.Addr()
+}
+
+// Close implements the [io.Closer] interface for *listener.
+func (l *listener) Close() (err error) {
+	if l.packetConn != nil {
+		return l.packetConn.Close()
+	}
+
+	return l.Listener.Close()
+}
+
+// originalDst returns the original destination of the connection accepted by
+// the transparent listener.  It returns an invalid address if the listener is
+// not transparent.
+func (l *listener) originalDst(conn net.Conn) (addr netip.AddrPort, err error) {
+	switch l.transparent {
+	case TransparentRedirect:
+		return getOriginalDst(conn)
+	case TransparentTProxy:
+		// The TPROXY target keeps the original destination as is.
+		return netutil.NetAddrToAddrPort(conn.LocalAddr()), nil
+	default:
+		return addr, nil
+	}
+}
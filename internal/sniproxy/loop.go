@@ -0,0 +1,141 @@
+package gorao
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// errLoop is returned when the proxy is about to connect to itself.
+var errLoop = errors.New("destination points to gorao itself")
+
+// loopDetector checks the addresses the proxy connects to and refuses
+// connections to gorao itself.  Otherwise such connections would be tunneled
+// to gorao recursively until it runs out of file descriptors.
+type loopDetector struct {
+	// selfAddrs are the addresses that point to gorao, e.g. the DNS redirect
+	// addresses.  Connections to them are refused on selfPorts and on the
+	// ports of the listeners.
+	selfAddrs []netip.Addr
+
+	// selfPorts are the ports the clients connect to gorao on.  They may
+	// differ from the listen ports when the ports are mapped, e.g. by Docker
+	// or the firewall.
+	selfPorts []uint16
+
+	// mu protects listenAddrs and localAddrs.
+	mu sync.RWMutex
+
+	// listenAddrs are the addresses gorao listens to.
+	listenAddrs []netip.AddrPort
+
+	// localAddrs are the addresses of the local network interfaces.  They
+	// are used to check the listeners bound to unspecified addresses.
+	localAddrs []netip.Addr
+}
+
+// newLoopDetector creates a new *loopDetector.  The self addresses are
+// considered gorao's on the destination ports of listeners and on the default
+// HTTP and HTTPS ports.
+func newLoopDetector(selfAddrs []netip.Addr, listeners []*listener) (d *loopDetector) {
+	selfPorts := []uint16{remotePortPlain, remotePortTLS}
+	for _, l := range listeners {
+		if !slices.Contains(selfPorts, l.destPort) {
+			selfPorts = append(selfPorts, l.destPort)
+		}
+	}
+
+	return &loopDetector{
+		selfAddrs: selfAddrs,
+		selfPorts: selfPorts,
+	}
+}
+
+// setListeners sets the addresses of gorao's listeners.  It must be called
+// once the listeners are started so that the actual ports are known.
+func (d *loopDetector) setListeners(addrs []net.Addr) {
+	var listenAddrs []netip.AddrPort
+	for _, a := range addrs {
+		listenAddrs = append(listenAddrs, netutil.NetAddrToAddrPort(a))
+	}
+
+	var localAddrs []netip.Addr
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Debug("gorao: failed to get interface addresses: %v", err)
+	}
+
+	for _, a := range ifaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+				localAddrs = append(localAddrs, ip.Unmap())
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.listenAddrs = listenAddrs
+	d.localAddrs = localAddrs
+}
+
+// control is a [net.Dialer.ControlContext] function that refuses to connect
+// to gorao itself.  It is called with the resolved address, so it works
+// regardless of how the hostname has been resolved.  It must only be used for
+// the direct connections to the backends since the upstream proxies may run
+// on the same host.
+func (d *loopDetector) control(
+	_ context.Context,
+	_ string,
+	address string,
+	_ syscall.RawConn,
+) (err error) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		// Not an IP address, nothing to check.
+		return nil
+	}
+
+	addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	if d.isSelf(addrPort) {
+		return errLoop
+	}
+
+	return nil
+}
+
+// isSelf returns true if addrPort is the address of one of gorao's
+// listeners.  The self addresses are considered the addresses of every
+// listener and of the ports the clients connect to.
+func (d *loopDetector) isSelf(addrPort netip.AddrPort) (ok bool) {
+	ip := addrPort.Addr()
+	if slices.Contains(d.selfAddrs, ip) && slices.Contains(d.selfPorts, addrPort.Port()) {
+		return true
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, l := range d.listenAddrs {
+		if l.Port() != addrPort.Port() {
+			continue
+		}
+
+		switch {
+		case l.Addr() == ip, slices.Contains(d.selfAddrs, ip):
+			return true
+		case l.Addr().IsUnspecified() && (ip.IsLoopback() || slices.Contains(d.localAddrs, ip)):
+			return true
+		}
+	}
+
+	return false
+}
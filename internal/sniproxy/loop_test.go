@@ -0,0 +1,72 @@
+package gorao
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestLoopDetector_isSelf(t *testing.T) {
+	redirectIP := netip.MustParseAddr("192.0.2.1")
+	listenIP := netip.MustParseAddr("198.51.100.1")
+
+	d := newLoopDetector([]netip.Addr{redirectIP}, []*listener{{
+		proto:    ProtocolTLS,
+		destPort: remotePortTLS,
+	}, {
+		proto:    ProtocolTLS,
+		destPort: 8853,
+	}})
+
+	// The listeners are port-mapped, e.g. 443 to 8443.
+	d.setListeners([]net.Addr{
+		&net.TCPAddr{IP: listenIP.AsSlice(), Port: 8443},
+		&net.TCPAddr{IP: listenIP.AsSlice(), Port: 9853},
+	})
+
+	testCases := []struct {
+		name string
+		in   netip.AddrPort
+		want bool
+	}{{
+		name: "redirect_mapped_port",
+		in:   netip.AddrPortFrom(redirectIP, 443),
+		want: true,
+	}, {
+		name: "redirect_plain_port",
+		in:   netip.AddrPortFrom(redirectIP, 80),
+		want: true,
+	}, {
+		name: "redirect_dest_port",
+		in:   netip.AddrPortFrom(redirectIP, 8853),
+		want: true,
+	}, {
+		name: "redirect_listen_port",
+		in:   netip.AddrPortFrom(redirectIP, 8443),
+		want: true,
+	}, {
+		name: "redirect_other_port",
+		in:   netip.AddrPortFrom(redirectIP, 22),
+		want: false,
+	}, {
+		name: "listen_addr",
+		in:   netip.AddrPortFrom(listenIP, 8443),
+		want: true,
+	}, {
+		name: "listen_addr_other_port",
+		in:   netip.AddrPortFrom(listenIP, 443),
+		want: false,
+	}, {
+		name: "other_addr",
+		in:   netip.MustParseAddrPort("203.0.113.1:443"),
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := d.isSelf(tc.in); got != tc.want {
+				t.Fatalf("isSelf(%s): got %t, want %t", tc.in, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package gorao
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// NoServerNameAction defines what the proxy does with the connections that
+// don't have a server name, i.e. TLS connections without SNI and plain HTTP
+// requests without the Host header.  TLS server names that are IP addresses
+// are treated the same way.
+type NoServerNameAction string
+
+const (
+	// NoServerNameReject means that the connection is closed.
+	NoServerNameReject NoServerNameAction = "reject"
+
+	// NoServerNameBackend means that the connection is tunneled to the
+	// default backend.
+	NoServerNameBackend NoServerNameAction = "backend"
+
+	// NoServerNameOriginalDst means that the connection is tunneled to its
+	// original destination if it has been accepted by a transparent listener.
+	// Otherwise, it is tunneled to the default backend if there is one or
+	// closed.
+	NoServerNameOriginalDst NoServerNameAction = "original-dst"
+)
+
+// ParseNoServerNameAction parses the action from its string representation.
+// An empty string is mapped to NoServerNameOriginalDst.
+func ParseNoServerNameAction(s string) (a NoServerNameAction, err error) {
+	switch a = NoServerNameAction(s); a {
+	case "":
+		return NoServerNameOriginalDst, nil
+	case NoServerNameReject, NoServerNameBackend, NoServerNameOriginalDst:
+		return a, nil
+	default:
+		return "", fmt.Errorf("gorao: unsupported no server name action %q", s)
+	}
+}
+
+// validateNoServerName checks the configuration of the connections without a
+// server name.
+func validateNoServerName(cfg *Config) (err error) {
+	if cfg.NoServerNameBackend != "" {
+		_, _, err = netutil.SplitHostPort(cfg.NoServerNameBackend)
+		if err != nil {
+			return fmt.Errorf("gorao: bad no server name backend: %w", err)
+		}
+	} else if cfg.NoServerNameAction == NoServerNameBackend {
+		return fmt.Errorf("gorao: no server name action %q requires a backend", NoServerNameBackend)
+	}
+
+	return nil
+}
+
+// hasServerName returns true if the connection accepted with the protocol has
+// a server name that can be used to choose the backend.  TLS and QUIC clients
+// must not send IP addresses in SNI, so such connections are treated as the
+// ones without a server name.
+func hasServerName(host string, proto Protocol) (ok bool) {
+	if host == "" {
+		return false
+	}
+
+	if proto != ProtocolTLS && proto != ProtocolQUIC {
+		return true
+	}
+
+	_, err := netip.ParseAddr(host)
+
+	return err != nil
+}
+
+// handleNoServerName chooses the backend for the connection without a server
+// name according to the configured action.  It returns false if the
+// connection must be rejected.
+func (p *Gorao) handleNoServerName(ctx *SNIContext) (ok bool) {
+	n := p.counters.noServerName.Add(1)
+
+	backend := ""
+	switch {
+	case p.noServerNameAction == NoServerNameReject:
+		// Go on.
+	case p.noServerNameAction == NoServerNameOriginalDst && ctx.OriginalDst.IsValid():
+		backend = ctx.OriginalDst.String()
+	default:
+		backend = p.noServerNameBackend
+	}
+
+	if backend == "" {
+		log.Info(
+			"gorao: [%d] rejected connection from %s without server name %q on listener %s "+
+				"(%d connections without server name so far)",
+			ctx.ID,
+			ctx.ClientAddr,
+			ctx.RemoteHost,
+			ctx.Listener,
+			n,
+		)
+
+		return false
+	}
+
+	log.Info(
+		"gorao: [%d] connection from %s without server name %q on listener %s goes to %s "+
+			"(%d connections without server name so far)",
+		ctx.ID,
+		ctx.ClientAddr,
+		ctx.RemoteHost,
+		ctx.Listener,
+		backend,
+		n,
+	)
+
+	ctx.RemoteAddr = backend
+
+	return true
+}
@@ -0,0 +1,111 @@
+//go:build linux
+
+package gorao
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSOOriginalDst is the IP6T_SO_ORIGINAL_DST socket option that returns
+// the original destination of an IPv6 connection redirected by ip6tables.
+const ip6tSOOriginalDst = 80
+
+// getOriginalDst returns the original destination of the connection that has
+// been redirected to gorao by an iptables REDIRECT or DNAT rule.
+func getOriginalDst(conn net.Conn) (addr netip.AddrPort, err error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return addr, fmt.Errorf("getting original destination: %T is not a socket", conn)
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return addr, fmt.Errorf("getting original destination: %w", err)
+	}
+
+	local := netutil.NetAddrToAddrPort(conn.LocalAddr()).Addr()
+
+	var optErr error
+	err = rc.Control(func(fd uintptr) {
+		if local.Is4() || local.Is4In6() {
+			addr, optErr = originalDst4(int(fd))
+		} else {
+			addr, optErr = originalDst6(int(fd))
+		}
+	})
+	if err == nil {
+		err = optErr
+	}
+
+	if err != nil {
+		return addr, fmt.Errorf("getting original destination: %w", err)
+	}
+
+	return addr, nil
+}
+
+// originalDst4 returns the original destination of the IPv4 connection.  The
+// kernel returns struct sockaddr_in, which fits into struct ip_mreq.
+func originalDst4(fd int) (addr netip.AddrPort, err error) {
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return addr, err
+	}
+
+	// struct sockaddr_in: family (2 bytes), port (2 bytes, network byte
+	// order), address (4 bytes).
+	b := mreq.Multiaddr
+	port := binary.BigEndian.Uint16(b[2:4])
+	ip := netip.AddrFrom4([4]byte(b[4:8]))
+
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// originalDst6 returns the original destination of the IPv6 connection.  The
+// kernel returns struct sockaddr_in6, which is the first field of struct
+// ip6_mtuinfo.
+func originalDst6(fd int) (addr netip.AddrPort, err error) {
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, ip6tSOOriginalDst)
+	if err != nil {
+		return addr, err
+	}
+
+	// The port is stored in network byte order.
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], info.Addr.Port)
+	port := binary.BigEndian.Uint16(b[:])
+
+	return netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), port), nil
+}
+
+// setTransparent is a [net.ListenConfig.Control] function that enables the
+// IP_TRANSPARENT option required for accepting connections redirected by an
+// iptables TPROXY rule.
+func setTransparent(network, _ string, rc syscall.RawConn) (err error) {
+	var optErr error
+	err = rc.Control(func(fd uintptr) {
+		// The network is either "tcp4" or "tcp6".  IPV6_TRANSPARENT covers
+		// the IPv4 connections accepted by a dual-stack socket as well.
+		if network == "tcp4" {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		} else {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		}
+	})
+	if err == nil {
+		err = optErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("setting IP_TRANSPARENT: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package gorao
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// errTransparentUnsupported is returned when transparent proxying is used on a
+// platform that does not support it.
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on linux")
+
+// getOriginalDst returns the original destination of the redirected
+// connection.  It is only supported on Linux.
+func getOriginalDst(_ net.Conn) (addr netip.AddrPort, err error) {
+	return addr, errTransparentUnsupported
+}
+
+// setTransparent is a [net.ListenConfig.Control] function that enables
+// transparent proxying.  It is only supported on Linux.
+func setTransparent(_, _ string, _ syscall.RawConn) (err error) {
+	return errTransparentUnsupported
+}
@@ -0,0 +1,181 @@
+package gorao
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/zamibd/gorao/internal/proxyproto"
+)
+
+// ProxyProtocolMode defines how a listener handles PROXY protocol headers
+// sent by a load balancer in front of gorao.
+type ProxyProtocolMode string
+
+const (
+	// ProxyProtocolOff means that PROXY protocol headers are not parsed.
+	ProxyProtocolOff ProxyProtocolMode = ""
+
+	// ProxyProtocolOptional means that a PROXY protocol header is parsed if
+	// it is sent by a trusted source.  Connections without a header are
+	// accepted as is.
+	ProxyProtocolOptional ProxyProtocolMode = "optional"
+
+	// ProxyProtocolRequire means that every connection must come from a
+	// trusted source and start with a PROXY protocol header.  Other
+	// connections are rejected.
+	ProxyProtocolRequire ProxyProtocolMode = "require"
+)
+
+// ParseProxyProtocolMode parses the PROXY protocol mode from its string
+// representation.  "off" and an empty string are both mapped to
+// ProxyProtocolOff.
+func ParseProxyProtocolMode(s string) (m ProxyProtocolMode, err error) {
+	switch m = ProxyProtocolMode(s); m {
+	case ProxyProtocolOff, ProxyProtocolOptional, ProxyProtocolRequire:
+		return m, nil
+	case "off":
+		return ProxyProtocolOff, nil
+	default:
+		return "", fmt.Errorf("gorao: unsupported proxy protocol mode %q", s)
+	}
+}
+
+// proxiedConn is a net.Conn that reads from a buffered reader and reports
+// the addresses parsed from a PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// type check
+var _ net.Conn = (*proxiedConn)(nil)
+
+// Read implements the net.Conn interface for *proxiedConn.
+func (c *proxiedConn) Read(b []byte) (n int, err error) { return c.reader.Read(b) }
+
+// RemoteAddr implements the net.Conn interface for *proxiedConn.
+func (c *proxiedConn) RemoteAddr() (addr net.Addr) { return c.remoteAddr }
+
+// LocalAddr implements the net.Conn interface for *proxiedConn.
+func (c *proxiedConn) LocalAddr() (addr net.Addr) { return c.localAddr }
+
+// CloseWrite closes the write side of the underlying connection if it is
+// supported.
+func (c *proxiedConn) CloseWrite() (err error) {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
+
+// SetLinger sets the linger of the underlying connection if it is supported.
+func (c *proxiedConn) SetLinger(sec int) (err error) {
+	if l, ok := c.Conn.(linger); ok {
+		return l.SetLinger(sec)
+	}
+
+	return nil
+}
+
+// SetKeepAliveConfig configures the TCP keepalive of the underlying connection
+// if it is supported.
+func (c *proxiedConn) SetKeepAliveConfig(cfg net.KeepAliveConfig) (err error) {
+	if ka, ok := c.Conn.(keepAliver); ok {
+		return ka.SetKeepAliveConfig(cfg)
+	}
+
+	return nil
+}
+
+// readProxyHeader reads a PROXY protocol header from conn according to mode
+// and returns a connection that reports the real client address.  If there's
+// no header, the returned connection still has to be used instead of conn
+// since some data may have been buffered.
+func (p *Gorao) readProxyHeader(
+	conn net.Conn,
+	mode ProxyProtocolMode,
+) (res net.Conn, err error) {
+	if mode == ProxyProtocolOff {
+		return conn, nil
+	}
+
+	src := netutil.NetAddrToAddrPort(conn.RemoteAddr())
+	if !p.isTrustedProxy(src.Addr()) {
+		if mode == ProxyProtocolRequire {
+			return nil, fmt.Errorf("gorao: untrusted proxy protocol source %s", src)
+		}
+
+		return conn, nil
+	}
+
+	pc := &proxiedConn{
+		Conn:       conn,
+		reader:     bufio.NewReader(conn),
+		remoteAddr: conn.RemoteAddr(),
+		localAddr:  conn.LocalAddr(),
+	}
+
+	h, err := proxyproto.Read(pc.reader)
+	switch {
+	case errors.Is(err, proxyproto.ErrNoHeader):
+		if mode == ProxyProtocolRequire {
+			return nil, fmt.Errorf("gorao: no proxy protocol header from %s", src)
+		}
+
+		return pc, nil
+	case err != nil:
+		return nil, fmt.Errorf("gorao: bad proxy protocol header from %s: %w", src, err)
+	}
+
+	if !h.Local {
+		pc.remoteAddr = net.TCPAddrFromAddrPort(h.Src)
+		pc.localAddr = net.TCPAddrFromAddrPort(h.Dst)
+	}
+
+	log.Debug("gorao: proxy protocol %s header from %s: client %s", h.Version, src, pc.remoteAddr)
+
+	return pc, nil
+}
+
+// isTrustedProxy returns true if addr is allowed to send PROXY protocol
+// headers.  If no trusted networks are configured, no source is trusted.
+func (p *Gorao) isTrustedProxy(addr netip.Addr) (ok bool) {
+	addr = addr.Unmap()
+	for _, pref := range p.proxyProtocolTrusted {
+		if pref.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeProxyHeader sends a PROXY protocol header with the client address to
+// the backend if there is a matching rule for it.
+func (p *Gorao) writeProxyHeader(ctx *SNIContext, backendConn net.Conn) (err error) {
+	v, _, ok := p.proxyProtocolRules.Match(ctx.target())
+	if !ok {
+		return nil
+	}
+
+	h := &proxyproto.Header{
+		Src:     ctx.ClientAddr,
+		Dst:     ctx.LocalAddr,
+		Version: v,
+	}
+
+	log.Debug("gorao: [%d] sending proxy protocol %s header for %s", ctx.ID, v, ctx.ClientAddr)
+
+	_, err = h.WriteTo(backendConn)
+
+	return err
+}
@@ -0,0 +1,608 @@
+package gorao
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/zamibd/gorao/internal/filter"
+	"github.com/zamibd/gorao/internal/quicinitial"
+)
+
+const (
+	// quicIdleTimeout is the time after which an idle QUIC flow is removed.
+	// QUIC endpoints usually close idle connections much earlier.
+	quicIdleTimeout = 1 * time.Minute
+
+	// quicMaxPending is the maximum number of datagrams of a flow buffered
+	// until its ClientHello is received completely.
+	quicMaxPending = 32
+
+	// quicMaxPendingFlows is the maximum number of flows of all listeners
+	// that haven't been established yet.  Any spoofed source address creates
+	// such a flow, so new flows are ignored over this limit.
+	quicMaxPendingFlows = 1024
+
+	// quicMaxPendingBytes is the maximum total size of the datagrams buffered
+	// by the flows of all listeners until they are established.
+	quicMaxPendingBytes = 16 << 20
+
+	// quicMaxDiscarded is the maximum number of the client addresses of the
+	// discarded flows a single listener remembers to ignore their
+	// retransmits.
+	quicMaxDiscarded = 1024
+
+	// quicMaxDatagram is the maximum size of a UDP datagram.
+	quicMaxDatagram = 65535
+)
+
+// quicFlowState is the state of a QUIC flow.
+type quicFlowState uint8
+
+const (
+	// quicFlowPending means that the flow is waiting for the rest of the
+	// ClientHello.
+	quicFlowPending quicFlowState = iota
+
+	// quicFlowDialing means that the flow is connecting to the backend.
+	quicFlowDialing
+
+	// quicFlowEstablished means that the datagrams are relayed to the
+	// backend.
+	quicFlowEstablished
+
+	// quicFlowDiscarded means that the flow has been removed.
+	quicFlowDiscarded
+)
+
+// quicFlow is the NAT state of the datagrams from a single client address.
+type quicFlow struct {
+	// ctx is the context of the flow.  It is nil until the ClientHello is
+	// received.
+	ctx *SNIContext
+
+	// backend is the connected UDP socket the datagrams are relayed to.  It is
+	// nil until the flow is established.
+	backend net.Conn
+
+	// assembler reassembles the ClientHello from the Initial packets.
+	assembler quicinitial.Assembler
+
+	// pending are the datagrams received before the flow is established.
+	// pendingBytes is their total size.
+	pending      [][]byte
+	pendingBytes int64
+
+	// release frees the slots the flow holds in the connection caps.
+	release func()
+
+	// created is the time the first datagram has been received.
+	created time.Time
+
+	// lastActive is the time of the last datagram in either direction, in
+	// Unix nanoseconds.
+	lastActive atomic.Int64
+
+	// bytesReceived and bytesSent are the numbers of bytes sent to the client
+	// and to the backend.
+	bytesReceived atomic.Int64
+	bytesSent     atomic.Int64
+
+	// state is the state of the flow.
+	state quicFlowState
+}
+
+// touch updates the time of the last activity of the flow.
+func (f *quicFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+// isPending returns true if the flow hasn't been established or discarded
+// yet.
+func (f *quicFlow) isPending() (ok bool) {
+	return f.state == quicFlowPending || f.state == quicFlowDialing
+}
+
+// quicRelay relays the QUIC flows of a single listener.
+type quicRelay struct {
+	p *Gorao
+	l *listener
+
+	// mu protects flows and their fields that aren't atomic.
+	mu sync.Mutex
+
+	// flows are the active flows by client address.
+	flows map[netip.AddrPort]*quicFlow
+
+	// discarded are the times of the last datagrams from the client
+	// addresses of the discarded flows.  Their datagrams are ignored until
+	// they have been idle for quicIdleTimeout.  The discarded flows don't
+	// hold any slots, and there are at most quicMaxDiscarded of them.
+	discarded map[netip.AddrPort]time.Time
+}
+
+// serveQUIC reads the datagrams from the QUIC listener and relays them to the
+// backends chosen by the server names of the Initial packets.  Once the
+// listener is closed, all its flows are closed as well since the responses
+// cannot be sent to the clients anymore.
+func (p *Gorao) serveQUIC(l *listener) {
+	defer p.wg.Done()
+
+	log.Info(
+		"gorao: listener %s: listening for %s datagrams on %s, destination port %d",
+		l.name,
+		l.proto,
+		l.localAddr(),
+		l.destPort,
+	)
+
+	r := &quicRelay{
+		p:         p,
+		l:         l,
+		flows:     map[netip.AddrPort]*quicFlow{},
+		discarded: map[netip.AddrPort]time.Time{},
+	}
+
+	stop := make(chan struct{})
+	p.wg.Add(1)
+	go r.expireLoop(stop)
+
+	defer func() {
+		close(stop)
+		r.closeAll()
+	}()
+
+	buf := make([]byte, quicMaxDatagram)
+	for {
+		n, addr, err := l.packetConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Info("gorao: listener %s: exiting listener loop as it has been closed", l.name)
+
+				return
+			}
+
+			log.Debug("gorao: listener %s: failed to read datagram: %v", l.name, err)
+
+			continue
+		}
+
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		r.handleDatagram(addr, buf[:n])
+	}
+}
+
+// handleDatagram relays the datagram from the client to the backend or
+// buffers it until the flow is established.
+func (r *quicRelay) handleDatagram(addr netip.AddrPort, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.discarded[addr]; ok {
+		r.discarded[addr] = time.Now()
+
+		return
+	}
+
+	f, ok := r.flows[addr]
+	if !ok {
+		if f = r.newFlow(addr); f == nil {
+			return
+		}
+	}
+
+	f.touch()
+
+	switch f.state {
+	case quicFlowEstablished:
+		n, err := f.backend.Write(data)
+		if err != nil {
+			log.Debug("gorao: [%d] failed to relay datagram: %v", f.ctx.ID, err)
+
+			return
+		}
+
+		f.bytesSent.Add(int64(n))
+	case quicFlowPending, quicFlowDialing:
+		r.buffer(addr, f, data)
+	}
+}
+
+// newFlow creates the flow for the datagrams from addr and reserves its slots
+// in the total and the per-client caps.  It returns nil if the datagram must
+// be ignored since the client is denied, a cap is reached or there are too
+// many pending flows.  r.mu must be locked.
+func (r *quicRelay) newFlow(addr netip.AddrPort) (f *quicFlow) {
+	if !r.l.clientFilter.Allowed(addr.Addr()) {
+		log.Debug("gorao: listener %s: denied datagrams from %s", r.l.name, addr)
+
+		return nil
+	}
+
+	if r.p.quicPendingFlows.Load() >= quicMaxPendingFlows {
+		log.Debug("gorao: listener %s: ignored datagram from %s: too many pending flows", r.l.name, addr)
+
+		return nil
+	}
+
+	release, ok := r.p.admitFlow(r.l, addr)
+	if !ok {
+		return nil
+	}
+
+	f = &quicFlow{
+		created: time.Now(),
+		release: release,
+	}
+	r.flows[addr] = f
+	r.p.quicPendingFlows.Add(1)
+
+	return f
+}
+
+// settle moves the flow to the state and frees its buffered datagrams.  It
+// must be called instead of changing the state of a pending flow directly so
+// that the pending flows are counted correctly.  r.mu must be locked.
+func (r *quicRelay) settle(f *quicFlow, state quicFlowState) {
+	if f.isPending() {
+		r.p.quicPendingFlows.Add(-1)
+	}
+
+	r.p.quicPendingBytes.Add(-f.pendingBytes)
+	f.pending, f.pendingBytes = nil, 0
+	f.state = state
+}
+
+// buffer saves the datagram of the flow that isn't established yet and starts
+// connecting to the backend once the ClientHello is received completely.
+// r.mu must be locked.
+func (r *quicRelay) buffer(addr netip.AddrPort, f *quicFlow, data []byte) {
+	if len(f.pending) >= quicMaxPending {
+		log.Debug("gorao: listener %s: too many datagrams from %s before handshake", r.l.name, addr)
+
+		r.discard(addr, f)
+
+		return
+	}
+
+	size := int64(len(data))
+	if r.p.quicPendingBytes.Load()+size > quicMaxPendingBytes {
+		// The client retransmits the Initial packets, so only the datagram is
+		// lost.
+		log.Debug("gorao: listener %s: ignored datagram from %s: too many pending bytes", r.l.name, addr)
+
+		return
+	}
+
+	f.pending = append(f.pending, slices.Clone(data))
+	f.pendingBytes += size
+	r.p.quicPendingBytes.Add(size)
+
+	if f.state != quicFlowPending {
+		return
+	}
+
+	pkt, err := quicinitial.Parse(data)
+	if errors.Is(err, quicinitial.ErrNotInitial) && len(f.pending) > 1 {
+		// E.g. a 0-RTT packet sent right after the Initial ones.
+		return
+	} else if err != nil {
+		log.Debug("gorao: listener %s: bad initial packet from %s: %v", r.l.name, addr, err)
+
+		r.discard(addr, f)
+
+		return
+	}
+
+	if err = f.assembler.Add(pkt.Crypto); err != nil {
+		log.Debug("gorao: listener %s: bad initial packet from %s: %v", r.l.name, addr, err)
+
+		r.discard(addr, f)
+
+		return
+	}
+
+	msg, ok := f.assembler.ClientHello()
+	if !ok {
+		return
+	}
+
+	f.state = quicFlowDialing
+
+	r.p.wg.Add(1)
+	go r.establish(addr, f, slices.Clone(msg))
+}
+
+// establish connects the flow to the backend chosen by the ClientHello msg,
+// sends the buffered datagrams there and relays the responses to the client
+// until the flow is closed.
+func (r *quicRelay) establish(addr netip.AddrPort, f *quicFlow, msg []byte) {
+	defer r.p.wg.Done()
+
+	ctx, backend, release, err := r.connect(addr, msg)
+	if err != nil {
+		log.Debug("gorao: error handling quic flow: %v", err)
+	}
+
+	if release != nil {
+		defer release()
+	}
+
+	if !r.setBackend(addr, f, ctx, backend) {
+		if backend != nil {
+			log.OnCloserError(backend, log.DEBUG)
+		}
+
+		return
+	}
+
+	r.p.trackConn(backend)
+	defer r.p.untrackConn(backend)
+
+	startTime := time.Now()
+
+	buf := make([]byte, quicMaxDatagram)
+	for {
+		n, rErr := backend.Read(buf)
+		if rErr != nil {
+			log.Debug("gorao: [%d] finished relaying due to %v", ctx.ID, rErr)
+
+			break
+		}
+
+		f.touch()
+
+		_, wErr := r.l.packetConn.WriteToUDPAddrPort(buf[:n], addr)
+		if wErr != nil {
+			log.Debug("gorao: [%d] finished relaying due to %v", ctx.ID, wErr)
+
+			break
+		}
+
+		f.bytesReceived.Add(int64(n))
+	}
+
+	r.remove(addr, f)
+
+	elapsed := time.Since(startTime)
+	bytesReceived, bytesSent := f.bytesReceived.Load(), f.bytesSent.Load()
+	bandwidthRate := float64(bytesReceived+bytesSent) / elapsed.Seconds()
+
+	log.Info(
+		"gorao: [%d] finished tunneling to %s. received %d, sent %d, elapsed: %v, "+
+			"rate (bytes/sec): %f",
+		ctx.ID,
+		ctx.RemoteAddr,
+		bytesReceived,
+		bytesSent,
+		elapsed,
+		bandwidthRate,
+	)
+}
+
+// setBackend makes the flow relay the datagrams to backend and sends the
+// buffered datagrams there.  If backend is nil, the flow is discarded.  It
+// returns false if the flow should not be relayed, e.g. because it has already
+// expired.
+func (r *quicRelay) setBackend(
+	addr netip.AddrPort,
+	f *quicFlow,
+	ctx *SNIContext,
+	backend net.Conn,
+) (ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.flows[addr] != f {
+		// Already removed.
+		return false
+	} else if backend == nil {
+		r.discard(addr, f)
+
+		return false
+	}
+
+	f.ctx = ctx
+	f.backend = backend
+
+	for _, data := range f.pending {
+		n, err := backend.Write(data)
+		if err != nil {
+			log.Debug("gorao: [%d] failed to relay datagram: %v", ctx.ID, err)
+
+			continue
+		}
+
+		f.bytesSent.Add(int64(n))
+	}
+
+	r.settle(f, quicFlowEstablished)
+
+	return true
+}
+
+// connect parses the ClientHello msg, applies the rules to the flow and
+// connects to its backend.  backend is nil if the flow must be discarded.
+// Otherwise, the caller must call release once the flow is removed.
+func (r *quicRelay) connect(
+	clientAddr netip.AddrPort,
+	msg []byte,
+) (ctx *SNIContext, backend net.Conn, release func(), err error) {
+	p, l := r.p, r.l
+
+	records := quicinitial.Records(msg)
+	hello, err := readClientHello(bytes.NewReader(records))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("gorao: failed to read client hello from %s: %w", clientAddr, err)
+	}
+
+	serverName := hello.ServerName
+	ctx = NewSNIContext(
+		serverName,
+		netutil.JoinHostPort(serverName, l.destPort),
+		clientAddr,
+		netutil.NetAddrToAddrPort(l.localAddr()),
+	)
+
+	ctx.Listener = l.name
+	setECH(ctx, parseECH(records))
+
+	if !hasServerName(ctx.RemoteHost, l.proto) && !p.handleNoServerName(ctx) {
+		return ctx, nil, nil, nil
+	}
+
+	p.setBackend(ctx)
+	ctx.Upstream = p.route(ctx)
+
+	log.Info(
+		"gorao: [%d] start tunneling from %s to %s via %s",
+		ctx.ID,
+		ctx.ClientAddr,
+		ctx.RemoteAddr,
+		ctx.Upstream,
+	)
+
+	if _, ok := filter.MatchRules(ctx.target(), p.blockRules); ok {
+		log.Info("gorao: [%d] blocked connection to %s", ctx.ID, ctx.RemoteHost)
+
+		return ctx, nil, nil, nil
+	}
+
+	if a, ok := p.dropAction(ctx); ok {
+		// Discarding the datagrams is exactly what a dropped connection looks
+		// like for a QUIC client, whatever the action is.  There is no TCP
+		// RST or FIN to send and trickling would break the packet pacing of
+		// QUIC anyway.
+		log.Info("gorao: [%d] dropped connection to %s: %s, discarding datagrams", ctx.ID, ctx.RemoteHost, a)
+
+		return ctx, nil, nil, nil
+	}
+
+	if ctx.Upstream != UpstreamDirect || isUnixAddr(ctx.RemoteAddr) {
+		log.Info(
+			"gorao: [%d] cannot relay quic to %s via %s, the client is expected to fall back to tcp",
+			ctx.ID,
+			ctx.RemoteAddr,
+			ctx.Upstream,
+		)
+
+		return ctx, nil, nil, nil
+	}
+
+	release, ok := p.admitHost(ctx, nil, ProtocolQUIC)
+	if !ok {
+		return ctx, nil, nil, nil
+	}
+
+	backend, err = p.dial(ctx, "udp")
+	if err != nil {
+		release()
+	}
+
+	if errors.Is(err, errLoop) {
+		log.Info(
+			"gorao: [%d] refused connection to %s: %v (%d loops so far)",
+			ctx.ID,
+			ctx.RemoteAddr,
+			err,
+			p.counters.loops.Add(1),
+		)
+
+		return ctx, nil, nil, nil
+	} else if err != nil {
+		return ctx, nil, nil, fmt.Errorf("gorao: [%d] failed to connect to %s: %w", ctx.ID, ctx.RemoteAddr, err)
+	}
+
+	return ctx, backend, release, nil
+}
+
+// expireLoop removes the expired flows until stop is closed.
+func (r *quicRelay) expireLoop(stop <-chan struct{}) {
+	defer r.p.wg.Done()
+
+	ticker := time.NewTicker(r.p.readTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			r.expire(now)
+		}
+	}
+}
+
+// expire removes the flows that have been idle for quicIdleTimeout and the
+// ones that haven't sent a complete ClientHello within the read timeout.  It
+// also forgets the discarded flows that have been idle for quicIdleTimeout.
+func (r *quicRelay) expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for addr, last := range r.discarded {
+		if now.Sub(last) > quicIdleTimeout {
+			delete(r.discarded, addr)
+		}
+	}
+
+	for addr, f := range r.flows {
+		idle := now.Sub(time.Unix(0, f.lastActive.Load()))
+		handshake := f.state == quicFlowPending && now.Sub(f.created) > r.p.readTimeout
+		if idle > quicIdleTimeout || handshake {
+			r.removeLocked(addr, f)
+		}
+	}
+}
+
+// remove removes the flow unless it has already been removed.
+func (r *quicRelay) remove(addr netip.AddrPort, f *quicFlow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.flows[addr] == f {
+		r.removeLocked(addr, f)
+	}
+}
+
+// discard removes the flow that isn't established and remembers its client
+// address to ignore the retransmits of its datagrams unless there are too many
+// discarded flows already.  r.mu must be locked.
+func (r *quicRelay) discard(addr netip.AddrPort, f *quicFlow) {
+	r.removeLocked(addr, f)
+
+	if len(r.discarded) < quicMaxDiscarded {
+		r.discarded[addr] = time.Now()
+	}
+}
+
+// removeLocked removes the flow and closes its backend socket.  r.mu must be
+// locked.
+func (r *quicRelay) removeLocked(addr netip.AddrPort, f *quicFlow) {
+	delete(r.flows, addr)
+
+	r.settle(f, quicFlowDiscarded)
+	f.release()
+
+	if f.backend != nil {
+		log.OnCloserError(f.backend, log.DEBUG)
+	}
+}
+
+// closeAll removes all flows.
+func (r *quicRelay) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for addr, f := range r.flows {
+		r.removeLocked(addr, f)
+	}
+}
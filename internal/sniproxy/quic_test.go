@@ -0,0 +1,81 @@
+package gorao
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestQUICRelay_discard(t *testing.T) {
+	const n = quicMaxDiscarded + 100
+
+	p, err := New(&Config{
+		MaxConns:       n,
+		MaxClientConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{{
+		name: "short",
+		data: []byte{0xc0},
+	}, {
+		name: "short_header",
+		data: make([]byte, 1200),
+	}, {
+		name: "garbage",
+		data: append([]byte{0xc3, 0, 0, 0, 1, 8}, make([]byte, 1200)...),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &quicRelay{
+				p:         p,
+				l:         &listener{name: "quic", proto: ProtocolQUIC},
+				flows:     map[netip.AddrPort]*quicFlow{},
+				discarded: map[netip.AddrPort]time.Time{},
+			}
+
+			for i := range n {
+				addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 443)
+
+				// Retransmits of the discarded flows must be ignored as well.
+				r.handleDatagram(addr, tc.data)
+				r.handleDatagram(addr, tc.data)
+			}
+
+			if len(r.flows) != 0 {
+				t.Errorf("got %d flows, want none", len(r.flows))
+			}
+
+			if len(r.discarded) > quicMaxDiscarded {
+				t.Errorf("got %d discarded flows, want at most %d", len(r.discarded), quicMaxDiscarded)
+			}
+
+			if got := p.quicPendingFlows.Load(); got != 0 {
+				t.Errorf("got %d pending flows, want none", got)
+			}
+
+			if got := p.quicPendingBytes.Load(); got != 0 {
+				t.Errorf("got %d pending bytes, want none", got)
+			}
+
+			p.limits.mu.Lock()
+			total, clients := p.limits.total, len(p.limits.clients)
+			p.limits.mu.Unlock()
+
+			if total != 0 || clients != 0 {
+				t.Errorf("got %d connections from %d clients, want none", total, clients)
+			}
+
+			r.expire(time.Now().Add(2 * quicIdleTimeout))
+			if len(r.discarded) != 0 {
+				t.Errorf("got %d discarded flows after expiry, want none", len(r.discarded))
+			}
+		})
+	}
+}
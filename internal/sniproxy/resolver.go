@@ -0,0 +1,134 @@
+package gorao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"golang.org/x/net/proxy"
+)
+
+// newResolver creates a caching resolver that sends queries to the specified
+// DNS upstream.  The upstream is queried directly, so the DNS proxy rules are
+// never applied to these lookups.
+func newResolver(addr string) (r *upstream.CachingResolver, ups upstream.Upstream, err error) {
+	ur, err := upstream.NewUpstreamResolver(addr, &upstream.Options{
+		Timeout: defaultConnectTimeout,
+	})
+	if err != nil {
+		var notBootstrapErr upstream.NotBootstrapError
+		if !errors.As(err, &notBootstrapErr) {
+			return nil, nil, fmt.Errorf("gorao: failed to init dns upstream %s: %w", addr, err)
+		}
+
+		// The upstream address is a hostname and will be resolved using the
+		// system resolver, it is still usable.
+		log.Info("gorao: warning: dns upstream %s: %v", addr, err)
+	}
+
+	return upstream.NewCachingResolver(ur), ur.Upstream, nil
+}
+
+// newDialer creates the dialer that resolves hostnames using resolver or the
+// system resolver if it's nil.  control is called before connecting to every
+// resolved address if it's not nil.  The connect timeouts are set per
+// connection, see Gorao.dial.
+func newDialer(
+	resolver upstream.Resolver,
+	control func(ctx context.Context, network, address string, c syscall.RawConn) (err error),
+) (d proxy.Dialer) {
+	if resolver == nil {
+		return &net.Dialer{
+			Resolver:       &net.Resolver{},
+			ControlContext: control,
+		}
+	}
+
+	return &resolvingDialer{
+		dialer: &net.Dialer{
+			ControlContext: control,
+		},
+		resolver: resolver,
+	}
+}
+
+// resolvingDialer is a proxy.Dialer that resolves hostnames using the
+// configured DNS upstream instead of the system resolver.
+type resolvingDialer struct {
+	dialer   *net.Dialer
+	resolver upstream.Resolver
+}
+
+// type check
+var _ proxy.Dialer = (*resolvingDialer)(nil)
+var _ proxy.ContextDialer = (*resolvingDialer)(nil)
+
+// Dial implements the proxy.Dialer interface for *resolvingDialer.
+func (d *resolvingDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements the proxy.ContextDialer interface for
+// *resolvingDialer.  It tries the resolved addresses one by one until it
+// manages to connect to one of them.
+func (d *resolvingDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (conn net.Conn, err error) {
+	addrs, err := d.resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, a := range addrs {
+		conn, err = d.dialer.DialContext(ctx, network, a.String())
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// resolve resolves the host of addr and returns the list of addresses to
+// connect to.  The lookup is limited by the deadline of ctx, i.e. the connect
+// timeout of the connection, see Gorao.dial.
+func (d *resolvingDialer) resolve(ctx context.Context, addr string) (addrs []netip.AddrPort, err error) {
+	host, port, err := netutil.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip, ipErr := netip.ParseAddr(host); ipErr == nil {
+		return []netip.AddrPort{netip.AddrPortFrom(ip, port)}, nil
+	}
+
+	start := time.Now()
+	ips, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", host, err)
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("resolving %s: no addresses", host)
+	}
+
+	log.Debug("gorao: resolved %s to %v in %v", host, ips, time.Since(start))
+
+	for _, ip := range ips {
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), port))
+	}
+
+	return addrs, nil
+}
@@ -1,6 +1,13 @@
 package gorao
 
-import "sync/atomic"
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/zamibd/gorao/internal/fault"
+	"github.com/zamibd/gorao/internal/filter"
+)
 
 var lastID uint64
 
@@ -16,13 +23,74 @@ type SNIContext struct {
 	// RemoteAddr is the address the proxy will connect to.  Basically, it is
 	// just remoteHost:remotePort.
 	RemoteAddr string
+
+	// ClientAddr is the address of the client.  If the connection came through
+	// a load balancer that sent a PROXY protocol header, it is the address
+	// from that header.
+	ClientAddr netip.AddrPort
+
+	// LocalAddr is the address the client has connected to.  If the
+	// connection came through a load balancer that sent a PROXY protocol
+	// header, it is the destination address from that header.
+	LocalAddr netip.AddrPort
+
+	// OriginalDst is the original destination of the connection redirected
+	// to a transparent listener.  It is invalid if the listener is not
+	// transparent.
+	OriginalDst netip.AddrPort
+
+	// ECH is true if the TLS ClientHello has the Encrypted Client Hello
+	// extension.  In this case RemoteHost is the public name from the outer
+	// ClientHello and not the name of the real site.
+	ECH bool
+
+	// ECHOuterServerName is the server name from the outer ClientHello.  It is
+	// empty if ECH is false.
+	ECHOuterServerName string
+
+	// ECHConfigID is the identifier of the ECH configuration the inner
+	// ClientHello was encrypted with.  It is zero if ECH is false.
+	ECHConfigID uint8
+
+	// Listener is the name of the listener that has accepted the connection.
+	Listener string
+
+	// Upstream is the name of the upstream the connection is tunneled
+	// through.  It is UpstreamDirect if the connection is not forwarded.
+	Upstream string
+
+	// Trickle is the time the connection matching a trickle drop action is
+	// tunneled very slowly for.  It is zero for other connections.
+	Trickle time.Duration
+
+	// Faults are the faults injected into the tunnel.  The random parameters
+	// are already chosen: the Period of fault.Stall is the stall itself and
+	// the Bytes of fault.Corrupt is the offset of the corrupted byte.
+	Faults []fault.Fault
 }
 
 // NewSNIContext creates a new instance of *SNIContext.
-func NewSNIContext(remoteHost string, remoteAddr string) (c *SNIContext) {
+func NewSNIContext(
+	remoteHost string,
+	remoteAddr string,
+	clientAddr netip.AddrPort,
+	localAddr netip.AddrPort,
+) (c *SNIContext) {
 	return &SNIContext{
 		ID:         atomic.AddUint64(&lastID, 1),
 		RemoteHost: remoteHost,
 		RemoteAddr: remoteAddr,
+		ClientAddr: clientAddr,
+		LocalAddr:  localAddr,
+	}
+}
+
+// target returns the target the connection rules are matched against.
+func (c *SNIContext) target() (t *filter.Target) {
+	return &filter.Target{
+		Host:     c.RemoteHost,
+		Listener: c.Listener,
+		Dst:      c.OriginalDst,
+		ECH:      c.ECH,
 	}
 }
@@ -7,21 +7,27 @@ package gorao
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"net/http"
-	"net/url"
-	"strings"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
-	"github.com/IGLOU-EU/go-wildcard"
+	"github.com/zamibd/gorao/internal/drop"
 	"github.com/zamibd/gorao/internal/filter"
+	"github.com/zamibd/gorao/internal/proxypool"
+	"github.com/zamibd/gorao/internal/proxyproto"
 	"github.com/zamibd/gorao/internal/shapeio"
 	"golang.org/x/net/proxy"
 	"golang.org/x/time/rate"
@@ -31,22 +37,32 @@ import (
 )
 
 const (
-	// readTimeout is the default timeout for a connection read deadline.
-	readTimeout = 10 * time.Second
+	// defaultReadTimeout is the default time the proxy waits for the first
+	// bytes of a new client connection, e.g. the ClientHello.
+	defaultReadTimeout = 10 * time.Second
 
-	// connectionTimeout is a timeout for connecting to a remote host.
-	connectionTimeout = 10 * time.Second
+	// defaultConnectTimeout is the default timeout for connecting to a remote
+	// host.
+	defaultConnectTimeout = 10 * time.Second
 
-	// dropPeriod is a period of time the proxy waits before closing the
-	// connection if there is a matching "drop rule".
-	dropPeriod = 3 * time.Minute
+	// defaultDropPeriod is the default period of time the dropped connections
+	// hang or trickle.
+	defaultDropPeriod = 3 * time.Minute
+
+	// defaultHTTPIdleTimeout is the default time the proxy waits for the next
+	// request on a keep-alive connection in HTTPModeRequest.
+	defaultHTTPIdleTimeout = 2 * time.Minute
+
+	// defaultHTTPMaxBackends is the default maximum number of backend
+	// connections a single client connection keeps in HTTPModeRequest.
+	defaultHTTPMaxBackends = 8
 
 	// remotePortPlain is the port the proxy will be connecting for plain HTTP
-	// connections.
+	// connections unless the listener specifies another one.
 	remotePortPlain = 80
 
 	// remotePortTLS is the port the proxy will be connecting to for TLS
-	// connection.
+	// connection unless the listener specifies another one.
 	remotePortTLS = 443
 )
 
@@ -55,21 +71,130 @@ const (
 // hosts.  Also, it can handle plain HTTP connections, parse the target host
 // and tunnel traffic there.
 type Gorao struct {
-	tlsListenAddr  *net.TCPAddr
-	httpListenAddr *net.TCPAddr
+	// listeners are the configured listeners.
+	listeners []*listener
+
+	// dialer is used for direct connections to the backends, it refuses to
+	// connect to gorao itself.  The upstream proxies use their own dialer.
+	dialer proxy.Dialer
+
+	// resolverUpstream is the DNS upstream dialer uses to resolve hostnames.
+	// It is nil if the system resolver is used.
+	resolverUpstream io.Closer
+
+	// loops refuses connections to gorao itself.
+	loops *loopDetector
+
+	// counters are the statistics counters.
+	counters counters
+
+	// limits are the caps on concurrent connections.
+	limits *connLimits
+
+	// quicPendingFlows and quicPendingBytes are the number of the QUIC flows
+	// of all listeners that aren't established yet and the total size of
+	// the datagrams they have buffered.
+	quicPendingFlows atomic.Int64
+	quicPendingBytes atomic.Int64
+
+	// upstreams is the map of named upstream proxies.
+	upstreams map[string]proxy.Dialer
+
+	// pools are the upstreams that consist of several proxies.
+	pools []*proxypool.Pool
+
+	// forwardRoutes maps rules to the names of upstreams.
+	forwardRoutes *filter.RuleMap[string]
+
+	// noServerNameAction and noServerNameBackend define what happens to the
+	// connections without a server name.
+	noServerNameAction  NoServerNameAction
+	noServerNameBackend string
+
+	// backendRules maps rules to the backend addresses that override the
+	// remote addresses of the matching connections.
+	backendRules *filter.RuleMap[string]
+
+	forwardRules     []*filter.Rule
+	originalDstRules []*filter.Rule
+	blockRules       []*filter.Rule
+	dropRules        []*filter.Rule
+
+	// blockPage is the response to the blocked plain HTTP requests, nil if
+	// there is none.
+	blockPage *blockPage
 
-	sniListener   net.Listener
-	plainListener net.Listener
+	// blockResponses maps rules to the ways the matching blocked connections
+	// are rejected.
+	blockResponses *filter.RuleMap[BlockResponse]
 
-	dialer      *net.Dialer
-	proxyDialer proxy.Dialer
+	// dropActions maps rules to the ways the matching connections are
+	// dropped.  dropPeriod is the default time they hang or trickle.
+	dropActions *filter.RuleMap[drop.Action]
+	dropPeriod  time.Duration
 
-	forwardRules []string
-	blockRules   []string
-	dropRules    []string
+	// faultRules maps rules to the faults injected into the matching tunnels
+	// with their probabilities.  faultSeed seeds the random choice of them.
+	faultRules *filter.RuleMap[*faultRule]
+	faultSeed  uint64
+
+	proxyProtocolTrusted []netip.Prefix
+	proxyProtocolRules   *filter.RuleMap[proxyproto.Version]
 
 	limiter        *rate.Limiter
-	bandwidthRules map[string]float64
+	bandwidthRules *filter.RuleMap[float64]
+
+	// readTimeout is the time the proxy waits for the first bytes of a new
+	// client connection.
+	readTimeout time.Duration
+
+	// readTimeoutRules map rules to the read timeouts of the matching
+	// requests, see Config.ReadTimeoutRules.
+	readTimeoutRules *filter.RuleMap[time.Duration]
+
+	// backendResponseTimeoutRules map rules to the time the proxy waits for
+	// the first bytes of the responses from the backends of the matching
+	// connections.
+	backendResponseTimeoutRules *filter.RuleMap[time.Duration]
+
+	// connectTimeout is the timeout for connecting to the backends,
+	// connectTimeoutRules override it for the matching connections.
+	connectTimeout      time.Duration
+	connectTimeoutRules *filter.RuleMap[time.Duration]
+
+	// idleTimeout, maxLifetime and keepAlive are the global tunnel limits,
+	// the rules override them for the matching connections.
+	idleTimeout      time.Duration
+	idleTimeoutRules *filter.RuleMap[time.Duration]
+	maxLifetime      time.Duration
+	maxLifetimeRules *filter.RuleMap[time.Duration]
+	keepAlive        time.Duration
+	keepAliveRules   *filter.RuleMap[time.Duration]
+
+	// httpIdleTimeout is the time the proxy waits for the next request on a
+	// keep-alive connection in HTTPModeRequest, httpMaxBackends is the
+	// maximum number of backend connections such a connection keeps.
+	httpIdleTimeout time.Duration
+	httpMaxBackends int
+
+	// drainTimeout is the time Close waits for the active connections to
+	// finish before closing them forcibly.
+	drainTimeout time.Duration
+
+	// conns is the set of active client and backend connections.  It is used
+	// to close them forcibly once drainTimeout is over.
+	conns   map[net.Conn]struct{}
+	connsMu sync.Mutex
+
+	// wg tracks the accept loops and the connection handlers.
+	wg sync.WaitGroup
+
+	// done is closed when Close is called.  Dropped connections are waiting
+	// for it so that they don't delay the shutdown.
+	done chan struct{}
+
+	// closeOnce makes the repeated calls of Close no-op.
+	closeOnce sync.Once
 }
 
 // type check
@@ -77,108 +202,352 @@ var _ io.Closer = (*Gorao)(nil)
 
 // New creates a new instance of *Gorao.
 func New(cfg *Config) (d *Gorao, err error) {
-	dialer := &net.Dialer{
-		Timeout:  connectionTimeout,
-		Resolver: &net.Resolver{},
+	listeners, err := newListeners(cfg.Listeners, cfg.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, err
 	}
 
-	var proxyDialer proxy.Dialer
-	if cfg.ForwardProxy != "" {
-		var u *url.URL
-		u, err = url.Parse(cfg.ForwardProxy)
-		if err != nil {
-			return nil, fmt.Errorf(
-				"gorao: failed to parse forward-proxy %s: %w",
-				cfg.ForwardProxy,
-				err,
-			)
-		}
+	if cfg.HTTPMaxBackends < 0 {
+		return nil, fmt.Errorf("gorao: http max backends %d is negative", cfg.HTTPMaxBackends)
+	}
 
-		proxyDialer, err = proxy.FromURL(u, dialer)
+	loops := newLoopDetector(cfg.SelfAddrs, listeners)
+
+	var resolver upstream.Resolver
+	var resolverUpstream io.Closer
+	if cfg.DNSUpstream != "" {
+		resolver, resolverUpstream, err = newResolver(cfg.DNSUpstream)
 		if err != nil {
-			return nil, fmt.Errorf(
-				"gorao: failed to init forward-proxy %s: %w",
-				cfg.ForwardProxy,
-				err,
-			)
+			return nil, err
 		}
 	}
 
-	var limiter *rate.Limiter
+	// Only the direct connections are checked for loops, the upstream
+	// proxies may legitimately run on the same host as gorao.
+	upstreams, pools, err := newUpstreams(cfg, newDialer(resolver, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	d = &Gorao{
+		listeners:            listeners,
+		dialer:               newDialer(resolver, loops.control),
+		resolverUpstream:     resolverUpstream,
+		loops:                loops,
+		upstreams:            upstreams,
+		pools:                pools,
+		proxyProtocolTrusted: cfg.ProxyProtocolTrusted,
+		noServerNameAction:   cfg.NoServerNameAction,
+		noServerNameBackend:  cfg.NoServerNameBackend,
+		drainTimeout:         cfg.DrainTimeout,
+		readTimeout:          cmp.Or(cfg.ReadTimeout, defaultReadTimeout),
+		connectTimeout:       cmp.Or(cfg.ConnectTimeout, defaultConnectTimeout),
+		idleTimeout:          cfg.TunnelIdleTimeout,
+		maxLifetime:          cfg.TunnelMaxLifetime,
+		keepAlive:            cfg.KeepAlive,
+		dropPeriod:           cmp.Or(cfg.DropPeriod, defaultDropPeriod),
+		httpIdleTimeout:      cmp.Or(cfg.HTTPIdleTimeout, defaultHTTPIdleTimeout),
+		httpMaxBackends:      cmp.Or(cfg.HTTPMaxBackends, defaultHTTPMaxBackends),
+		faultSeed:            cfg.FaultSeed,
+		conns:                map[net.Conn]struct{}{},
+		done:                 make(chan struct{}),
+	}
+
+	err = d.initRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Faults) > 0 {
+		if d.faultSeed == 0 {
+			d.faultSeed = rand.Uint64()
+		}
+
+		log.Info("gorao: injecting faults with seed %d", d.faultSeed)
+	}
 
 	if cfg.BandwidthRate > 0 {
-		limiter = rate.NewLimiter(rate.Limit(cfg.BandwidthRate), 1000_000_000)
+		d.limiter = rate.NewLimiter(rate.Limit(cfg.BandwidthRate), 1000_000_000)
 		// spend initial burst.
-		limiter.AllowN(time.Now(), 1000_000_000)
-	}
-
-	return &Gorao{
-		tlsListenAddr:  cfg.TLSListenAddr,
-		httpListenAddr: cfg.HTTPListenAddr,
-		dialer:         dialer,
-		proxyDialer:    proxyDialer,
-		forwardRules:   cfg.ForwardRules,
-		blockRules:     cfg.BlockRules,
-		dropRules:      cfg.DropRules,
-		limiter:        limiter,
-		bandwidthRules: cfg.BandwidthRules,
-	}, nil
+		d.limiter.AllowN(time.Now(), 1000_000_000)
+	}
+
+	return d, nil
+}
+
+// initRules parses the rules from the configuration.
+func (p *Gorao) initRules(cfg *Config) (err error) {
+	if p.forwardRules, err = filter.ParseRules(cfg.ForwardRules); err != nil {
+		return fmt.Errorf("gorao: forward rules: %w", err)
+	}
+
+	if p.originalDstRules, err = filter.ParseRules(cfg.OriginalDstRules); err != nil {
+		return fmt.Errorf("gorao: original destination rules: %w", err)
+	}
+
+	if p.blockRules, err = filter.ParseRules(cfg.BlockRules); err != nil {
+		return fmt.Errorf("gorao: block rules: %w", err)
+	}
+
+	if p.blockPage, err = newBlockPage(cfg); err != nil {
+		return err
+	}
+
+	if p.blockResponses, err = filter.NewRuleMap(cfg.BlockResponses); err != nil {
+		return fmt.Errorf("gorao: block responses: %w", err)
+	}
+
+	if p.limits, err = newConnLimits(cfg); err != nil {
+		return err
+	}
+
+	if p.readTimeoutRules, err = filter.NewRuleMap(cfg.ReadTimeoutRules); err != nil {
+		return fmt.Errorf("gorao: read timeout rules: %w", err)
+	}
+
+	p.backendResponseTimeoutRules, err = filter.NewRuleMap(cfg.BackendResponseTimeoutRules)
+	if err != nil {
+		return fmt.Errorf("gorao: backend response timeout rules: %w", err)
+	}
+
+	if p.connectTimeoutRules, err = filter.NewRuleMap(cfg.ConnectTimeoutRules); err != nil {
+		return fmt.Errorf("gorao: connect timeout rules: %w", err)
+	}
+
+	if p.idleTimeoutRules, err = filter.NewRuleMap(cfg.TunnelIdleTimeoutRules); err != nil {
+		return fmt.Errorf("gorao: tunnel idle timeout rules: %w", err)
+	}
+
+	if p.maxLifetimeRules, err = filter.NewRuleMap(cfg.TunnelMaxLifetimeRules); err != nil {
+		return fmt.Errorf("gorao: tunnel max lifetime rules: %w", err)
+	}
+
+	if p.keepAliveRules, err = filter.NewRuleMap(cfg.KeepAliveRules); err != nil {
+		return fmt.Errorf("gorao: keepalive rules: %w", err)
+	}
+
+	if p.dropRules, err = filter.ParseRules(cfg.DropRules); err != nil {
+		return fmt.Errorf("gorao: drop rules: %w", err)
+	}
+
+	if p.dropActions, err = filter.NewRuleMap(cfg.DropActions); err != nil {
+		return fmt.Errorf("gorao: drop actions: %w", err)
+	}
+
+	if p.faultRules, err = newFaultRules(cfg.Faults); err != nil {
+		return fmt.Errorf("gorao: fault rules: %w", err)
+	}
+
+	if p.forwardRoutes, err = filter.NewRuleMap(cfg.ForwardRoutes); err != nil {
+		return fmt.Errorf("gorao: forward routes: %w", err)
+	}
+
+	if err = validateNoServerName(cfg); err != nil {
+		return err
+	}
+
+	if err = validateBackendRules(cfg.BackendRules); err != nil {
+		return err
+	}
+
+	if p.backendRules, err = filter.NewRuleMap(cfg.BackendRules); err != nil {
+		return fmt.Errorf("gorao: backend rules: %w", err)
+	}
+
+	if p.proxyProtocolRules, err = filter.NewRuleMap(cfg.ProxyProtocolRules); err != nil {
+		return fmt.Errorf("gorao: proxy protocol rules: %w", err)
+	}
+
+	if p.bandwidthRules, err = filter.NewRuleMap(cfg.BandwidthRules); err != nil {
+		return fmt.Errorf("gorao: bandwidth rules: %w", err)
+	}
+
+	return nil
 }
 
 // Start starts the Gorao server.
 func (p *Gorao) Start() (err error) {
 	log.Info("gorao: starting")
 
-	p.sniListener, err = net.ListenTCP("tcp", p.tlsListenAddr)
-	if err != nil {
-		return fmt.Errorf("gorao: failed to start gorao: %w", err)
+	var addrs []net.Addr
+	for i, l := range p.listeners {
+		err = l.listen()
+		if err != nil {
+			for _, started := range p.listeners[:i] {
+				log.OnCloserError(started, log.DEBUG)
+			}
+
+			return fmt.Errorf("gorao: failed to start gorao: %w", err)
+		}
+
+		addrs = append(addrs, l.localAddr())
 	}
 
-	p.plainListener, err = net.ListenTCP("tcp", p.httpListenAddr)
-	if err != nil {
-		return fmt.Errorf("gorao: failed to start gorao: %w", err)
+	p.loops.setListeners(addrs)
+
+	for _, pool := range p.pools {
+		pool.Start()
 	}
 
-	go p.acceptLoop(p.sniListener, false)
-	go p.acceptLoop(p.plainListener, true)
+	p.wg.Add(len(p.listeners))
+	for _, l := range p.listeners {
+		if l.proto == ProtocolQUIC {
+			go p.serveQUIC(l)
+		} else {
+			go p.acceptLoop(l)
+		}
+	}
 
 	log.Info("gorao: started successfully")
 
 	return nil
 }
 
-// Close implements the [io.Closer] interface for Gorao.
-//
-// TODO(ameshkov): wait until all workers finish their work.
+// Close implements the [io.Closer] interface for Gorao.  It stops accepting
+// new connections and waits for the active tunnels to finish.  The tunnels
+// that are still active after drainTimeout are closed forcibly.  Only the
+// first call has effect.
 func (p *Gorao) Close() (err error) {
+	p.closeOnce.Do(func() { err = p.shutdown() })
+
+	return err
+}
+
+// shutdown stops gorao, see Close.
+func (p *Gorao) shutdown() (err error) {
 	log.Info("gorao: stopping")
 
-	sniErr := p.sniListener.Close()
-	plainErr := p.plainListener.Close()
+	close(p.done)
+
+	var errs []error
+	for _, l := range p.listeners {
+		errs = append(errs, l.Close())
+	}
+
+	log.Info(
+		"gorao: waiting up to %v for %d active connections to finish",
+		p.drainTimeout,
+		p.activeConns(),
+	)
+
+	if !p.waitDrain() {
+		n := p.closeConns()
+		log.Info("gorao: drain timeout exceeded, closed %d connections forcibly", n)
+
+		p.wg.Wait()
+	}
+
+	for _, pool := range p.pools {
+		log.OnCloserError(pool, log.DEBUG)
+	}
+
+	if p.resolverUpstream != nil {
+		log.OnCloserError(p.resolverUpstream, log.DEBUG)
+	}
+
+	p.logStats()
 
 	log.Info("gorao: stopped")
 
-	return errors.Join(sniErr, plainErr)
+	return errors.Join(errs...)
+}
+
+// waitDrain waits until all connection handlers finish their work or until
+// drainTimeout is over.  It returns false if the timeout has been exceeded.
+func (p *Gorao) waitDrain() (ok bool) {
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(p.drainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// trackConn adds conn to the set of active connections.
+func (p *Gorao) trackConn(conn net.Conn) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	p.conns[conn] = struct{}{}
+}
+
+// untrackConn removes conn from the set of active connections.
+func (p *Gorao) untrackConn(conn net.Conn) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	delete(p.conns, conn)
+}
+
+// activeConns returns the number of active connections.
+func (p *Gorao) activeConns() (n int) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	return len(p.conns)
+}
+
+// closeConns forcibly closes all active connections and returns the number
+// of closed connections.
+func (p *Gorao) closeConns() (n int) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	for conn := range p.conns {
+		log.OnCloserError(conn, log.DEBUG)
+	}
+
+	return len(p.conns)
 }
 
 // acceptLoop accepts incoming TCP connections and starts goroutines processing
 // them.
-func (p *Gorao) acceptLoop(l net.Listener, plainHTTP bool) {
-	if plainHTTP {
-		log.Info("gorao: listening for HTTP connections on %s", l.Addr())
-	} else {
-		log.Info("gorao: listening for TLS connections on %s", l.Addr())
-	}
+func (p *Gorao) acceptLoop(l *listener) {
+	defer p.wg.Done()
+
+	log.Info(
+		"gorao: listener %s: listening for %s connections on %s, destination port %d",
+		l.name,
+		l.proto,
+		l.Addr(),
+		l.destPort,
+	)
 
 	for {
 		conn, err := l.Accept()
-		if err != nil && strings.Contains(err.Error(), "closed network connection") {
-			log.Info("gorao: exiting listener loop as it has been closed")
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Info("gorao: listener %s: exiting listener loop as it has been closed", l.name)
+
+				return
+			}
+
+			log.Debug("gorao: failed to accept connection: %v", err)
 
-			return
+			continue
 		}
+
+		if !p.admit(conn, l) {
+			continue
+		}
+
+		p.trackConn(conn)
+		p.wg.Add(1)
 		go func() {
-			cErr := p.handleConnection(conn, plainHTTP)
+			defer p.wg.Done()
+			defer p.limits.releaseTotal()
+			defer p.untrackConn(conn)
+
+			cErr := p.handleConnection(conn, l)
 			if cErr != nil {
 				log.Debug("gorao: error handling connection: %v", cErr)
 			}
@@ -188,16 +557,60 @@ func (p *Gorao) acceptLoop(l net.Listener, plainHTTP bool) {
 
 // handleConnection handles a new incoming client connection, parses SNI or
 // HTTP request and tunnels traffic to the specified upstream.
-func (p *Gorao) handleConnection(clientConn net.Conn, plainHTTP bool) (err error) {
+func (p *Gorao) handleConnection(clientConn net.Conn, l *listener) (err error) {
 	defer log.OnCloserError(clientConn, log.DEBUG)
 
-	if err = clientConn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+	if err = clientConn.SetReadDeadline(time.Now().Add(p.readTimeout)); err != nil {
 		return fmt.Errorf("gorao: failed to set read deadline: %w", err)
 	}
 
-	serverName, clientReader, err := peekServerName(clientConn, plainHTTP)
+	// The original destination must be read from the accepted socket before
+	// it is wrapped.
+	originalDst, err := l.originalDst(clientConn)
 	if err != nil {
-		return fmt.Errorf("gorao: failed to peek server name: %w", err)
+		return fmt.Errorf("gorao: listener %s: %w", l.name, err)
+	}
+
+	clientConn, err = p.readProxyHeader(clientConn, l.proxyProtocol)
+	if err != nil {
+		return fmt.Errorf("gorao: rejected connection: %w", nameTimeout(err, "read", p.readTimeout))
+	}
+
+	clientAddr := netutil.NetAddrToAddrPort(clientConn.RemoteAddr())
+	if !l.clientFilter.Allowed(clientAddr.Addr()) {
+		log.Debug("gorao: listener %s: denied connection from %s", l.name, clientAddr)
+
+		return nil
+	}
+
+	releaseClient, ok := p.admitClient(clientConn, l, clientAddr)
+	if !ok {
+		return nil
+	}
+	defer releaseClient()
+
+	switch l.proto {
+	case ProtocolConnect:
+		return p.serveHTTPRequests(clientConn, bufio.NewReader(clientConn), l, originalDst)
+	case ProtocolSOCKS5:
+		return p.serveSOCKS5(clientConn, l)
+	}
+
+	var reader io.Reader = clientConn
+	if l.httpMode == HTTPModeRequest {
+		br := bufio.NewReader(clientConn)
+		if !isH2C(br) {
+			return p.serveHTTPRequests(clientConn, br, l, originalDst)
+		}
+
+		// HTTP/2 multiplexes the requests, so such connections are tunneled
+		// as a whole.
+		reader = br
+	}
+
+	serverName, ech, clientReader, err := peekServerName(reader, l.proto == ProtocolHTTP)
+	if err != nil {
+		return fmt.Errorf("gorao: failed to peek server name: %w", nameTimeout(err, "read", p.readTimeout))
 	}
 
 	if err = clientConn.SetReadDeadline(time.Time{}); err != nil {
@@ -209,40 +622,170 @@ func (p *Gorao) handleConnection(clientConn net.Conn, plainHTTP bool) (err error
 	hostname, remotePort, err := netutil.SplitHostPort(serverName)
 	if err == nil {
 		serverName = hostname
-	} else if plainHTTP {
-		remotePort = remotePortPlain
+	} else if originalDst.IsValid() {
+		remotePort = originalDst.Port()
 	} else {
-		remotePort = remotePortTLS
+		remotePort = l.destPort
 	}
 
 	remoteAddr := netutil.JoinHostPort(serverName, remotePort)
-	ctx := NewSNIContext(serverName, remoteAddr)
+	ctx := NewSNIContext(
+		serverName,
+		remoteAddr,
+		clientAddr,
+		netutil.NetAddrToAddrPort(clientConn.LocalAddr()),
+	)
 
-	log.Info("gorao: [%d] start tunneling to %s", ctx.ID, ctx.RemoteAddr)
+	ctx.Listener = l.name
+	ctx.OriginalDst = originalDst
+	setECH(ctx, ech)
 
-	if filter.MatchWildcards(ctx.RemoteHost, p.blockRules) {
-		log.Info("gorao: [%d] blocked connection to %s", ctx.ID, ctx.RemoteHost)
+	if !hasServerName(ctx.RemoteHost, l.proto) {
+		if !p.handleNoServerName(ctx) {
+			return nil
+		}
+	} else if p.useOriginalDst(ctx) {
+		ctx.RemoteAddr = originalDst.String()
+	}
+
+	p.setBackend(ctx)
+	ctx.Upstream = p.route(ctx)
+
+	log.Info(
+		"gorao: [%d] start tunneling from %s to %s via %s",
+		ctx.ID,
+		ctx.ClientAddr,
+		ctx.RemoteAddr,
+		ctx.Upstream,
+	)
+
+	if rule, ok := p.blocked(ctx); ok {
+		p.reject(ctx, clientConn, l.proto, rule)
 
 		return nil
 	}
 
-	if filter.MatchWildcards(ctx.RemoteHost, p.dropRules) {
-		log.Info("gorao: [%d] dropped connection to %s", ctx.ID, ctx.RemoteHost)
+	releaseHost, ok := p.admitHost(ctx, clientConn, l.proto)
+	if !ok {
+		return nil
+	}
+	defer releaseHost()
 
-		// Emulate the situation with a connection that was "dropped".
-		time.Sleep(dropPeriod)
+	if p.dropped(ctx, clientConn) {
+		return nil
+	}
 
+	backendConn, err := p.connect(ctx)
+	if errors.Is(err, errLoop) {
 		return nil
+	} else if err != nil {
+		return err
+	}
+	defer log.OnCloserError(backendConn, log.DEBUG)
+	defer p.untrackConn(backendConn)
+
+	p.relay(ctx, clientConn, clientReader, backendConn)
+
+	return nil
+}
+
+// newContext creates the context of the connection accepted by l to host,
+// which may also contain the port, and chooses its backend and upstream.  It
+// is used by the listeners that read the target from the requests, not from
+// the ClientHello.  It returns false if the connection must be rejected.
+func (p *Gorao) newContext(
+	l *listener,
+	clientConn net.Conn,
+	host string,
+	originalDst netip.AddrPort,
+) (ctx *SNIContext, ok bool) {
+	hostname, remotePort, err := netutil.SplitHostPort(host)
+	if err == nil {
+		host = hostname
+	} else if originalDst.IsValid() {
+		remotePort = originalDst.Port()
+	} else {
+		remotePort = l.destPort
+	}
+
+	ctx = NewSNIContext(
+		host,
+		netutil.JoinHostPort(host, remotePort),
+		netutil.NetAddrToAddrPort(clientConn.RemoteAddr()),
+		netutil.NetAddrToAddrPort(clientConn.LocalAddr()),
+	)
+
+	ctx.Listener = l.name
+	ctx.OriginalDst = originalDst
+
+	if !hasServerName(ctx.RemoteHost, l.proto) {
+		if !p.handleNoServerName(ctx) {
+			return nil, false
+		}
+	} else if p.useOriginalDst(ctx) {
+		ctx.RemoteAddr = originalDst.String()
+	}
+
+	p.setBackend(ctx)
+	ctx.Upstream = p.route(ctx)
+
+	return ctx, true
+}
+
+// blocked returns the block rule the connection matches and true if there is
+// one.
+func (p *Gorao) blocked(ctx *SNIContext) (rule *filter.Rule, ok bool) {
+	if rule, ok = filter.MatchRules(ctx.target(), p.blockRules); ok {
+		log.Info("gorao: [%d] blocked connection to %s", ctx.ID, ctx.RemoteHost)
 	}
 
-	backendConn, err := p.dial(ctx)
+	return rule, ok
+}
+
+// connect opens a TCP connection to the backend of ctx, starts tracking it,
+// and sends the PROXY protocol header if needed.  If the backend is gorao
+// itself, the refusal is logged and an error wrapping errLoop is returned.
+// The caller must untrack and close the connection.
+func (p *Gorao) connect(ctx *SNIContext) (backendConn net.Conn, err error) {
+	p.injectFaults(ctx)
+
+	backendConn, err = p.dial(ctx, "tcp")
+	if errors.Is(err, errLoop) {
+		log.Info(
+			"gorao: [%d] refused connection to %s: %v (%d loops so far)",
+			ctx.ID,
+			ctx.RemoteAddr,
+			err,
+			p.counters.loops.Add(1),
+		)
+
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("gorao: [%d] failed to connect to %s: %w", ctx.ID, ctx.RemoteAddr, err)
+	}
+
+	p.trackConn(backendConn)
+
+	err = p.writeProxyHeader(ctx, backendConn)
 	if err != nil {
-		return fmt.Errorf("gorao: [%d] failed to connect to %s: %w", ctx.ID, ctx.RemoteAddr, err)
+		p.untrackConn(backendConn)
+		log.OnCloserError(backendConn, log.DEBUG)
+
+		return nil, fmt.Errorf("gorao: [%d] failed to send proxy header to %s: %w", ctx.ID, ctx.RemoteAddr, err)
 	}
-	defer log.OnCloserError(backendConn, log.DEBUG)
 
+	return backendConn, nil
+}
+
+// relay tunnels the traffic between the client and the backend until both
+// directions are finished.  Trickled connections are closed once their period
+// is over.
+func (p *Gorao) relay(ctx *SNIContext, clientConn net.Conn, clientReader io.Reader, backendConn net.Conn) {
 	startTime := time.Now()
 
+	timers := p.startTimers(ctx, clientConn, backendConn)
+	defer timers.stop()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -251,12 +794,13 @@ func (p *Gorao) handleConnection(clientConn net.Conn, plainHTTP bool) (err error
 	go func() {
 		defer wg.Done()
 
-		bytesReceived = p.tunnel(ctx, clientConn, backendConn)
+		backendReader := p.faultReader(ctx, timers, p.backendReader(ctx, backendConn))
+		bytesReceived = p.tunnel(ctx, clientConn, timers.reader(backendReader))
 	}()
 	go func() {
 		defer wg.Done()
 
-		bytesSent = p.tunnel(ctx, backendConn, clientReader)
+		bytesSent = p.tunnel(ctx, backendConn, timers.reader(clientReader))
 	}()
 
 	wg.Wait()
@@ -268,40 +812,67 @@ func (p *Gorao) handleConnection(clientConn net.Conn, plainHTTP bool) (err error
 		"gorao: [%d] finished tunneling to %s. received %d, sent %d, elapsed: %v, "+
 			"rate (bytes/sec): %f",
 		ctx.ID,
-		remoteAddr,
+		ctx.RemoteAddr,
 		bytesReceived,
 		bytesSent,
 		elapsed,
 		bandwidthRate,
 	)
+}
 
-	return nil
+// wait blocks for the specified period of time or until the proxy is closed.
+func (p *Gorao) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-p.done:
+	}
 }
 
-// dial opens a TCP connection to the remote address specified in the context.
-// It also applies forward rules in the case if proxy dialer is specified.
-//
-// TODO(ameshkov): consider using DNSUpstream to resolve the specified hostname.
-func (p *Gorao) dial(ctx *SNIContext) (conn net.Conn, err error) {
-	if p.shouldForward(ctx) {
-		return p.proxyDialer.Dial("tcp", ctx.RemoteAddr)
+// dial opens a connection to the remote address specified in the context
+// through the upstream chosen for it.  network is either "tcp" or "udp".
+func (p *Gorao) dial(ctx *SNIContext, network string) (conn net.Conn, err error) {
+	timeout := p.connectTimeout
+	if t, _, ok := p.connectTimeoutRules.Match(ctx.target()); ok {
+		timeout = t
 	}
 
-	return p.dialer.Dial("tcp", ctx.RemoteAddr)
-}
+	if err = p.dialFault(ctx, timeout); err != nil {
+		return nil, err
+	}
 
-// shouldForward checks if the connection should be forwarded to the next proxy.
-func (p *Gorao) shouldForward(ctx *SNIContext) (ok bool) {
-	if p.proxyDialer == nil {
-		return false
+	if isUnixAddr(ctx.RemoteAddr) {
+		conn, err = dialUnix(ctx.RemoteAddr, timeout)
+
+		return conn, nameTimeout(err, "connect", timeout)
 	}
 
-	if len(p.forwardRules) == 0 {
-		// forward all connections if there are no rules.
-		return true
+	// The dialers check resolved addresses themselves, but an IP address
+	// passed to an upstream proxy needs to be checked here.
+	if addrPort, pErr := netip.ParseAddrPort(ctx.RemoteAddr); pErr == nil {
+		addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+		if p.loops.isSelf(addrPort) {
+			return nil, errLoop
+		}
 	}
 
-	return filter.MatchWildcards(ctx.RemoteHost, p.forwardRules)
+	dialCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	d := p.upstreamDialer(ctx.Upstream)
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(dialCtx, network, ctx.RemoteAddr)
+	} else {
+		conn, err = d.Dial(network, ctx.RemoteAddr)
+	}
+
+	if err != nil && dialCtx.Err() != nil {
+		return nil, &timeoutError{name: "connect", timeout: timeout, err: err}
+	}
+
+	return conn, err
 }
 
 // closeWriter is a helper interface which only purpose is to check if the
@@ -325,19 +896,21 @@ func (p *Gorao) tunnel(ctx *SNIContext, dst net.Conn, src io.Reader) (written in
 		}
 	}()
 
+	if ctx.Trickle > 0 {
+		src = trickleReader{r: src}
+	}
+
 	var reader = shapeio.NewReader(src, p.limiter)
 	var writer = shapeio.NewWriter(dst, p.limiter)
 
-	for k, v := range p.bandwidthRules {
-		if wildcard.MatchSimple(k, ctx.RemoteHost) {
-			log.Debug(
-				"gorao: [%d] limiting speed to %f bytes/sec",
-				ctx.ID,
-				v,
-			)
-			reader.SetRateLimit(v)
-			writer.SetRateLimit(v)
-		}
+	if v, ok := p.rateLimit(ctx); ok {
+		log.Debug(
+			"gorao: [%d] limiting speed to %f bytes/sec",
+			ctx.ID,
+			v,
+		)
+		reader.SetRateLimit(v)
+		writer.SetRateLimit(v)
 	}
 
 	written, err := io.Copy(writer, reader)
@@ -349,40 +922,63 @@ func (p *Gorao) tunnel(ctx *SNIContext, dst net.Conn, src io.Reader) (written in
 	return written
 }
 
+// rateLimit returns the speed limit of the connection in bytes per second and
+// true if there is one besides the global limit.
+func (p *Gorao) rateLimit(ctx *SNIContext) (v float64, ok bool) {
+	if ctx.Trickle > 0 {
+		return trickleRate, true
+	}
+
+	v, _, ok = p.bandwidthRules.Match(ctx.target())
+
+	return v, ok
+}
+
 // peekServerName peeks on the first bytes from the reader and tries to parse
 // the remote server name.  Depending on whether this is a TLS or a plain HTTP
-// connection it will use different ways of parsing.
+// connection it will use different ways of parsing.  ech is not nil if the TLS
+// ClientHello has the Encrypted Client Hello extension.
 func peekServerName(
 	reader io.Reader,
 	plainHTTP bool,
-) (serverName string, newReader io.Reader, err error) {
+) (serverName string, ech *echInfo, newReader io.Reader, err error) {
 	if plainHTTP {
 		serverName, newReader, err = peekHTTPHost(reader)
 
 		if err != nil {
-			return "", nil, err
+			return "", nil, nil, err
 		}
 	} else {
 		var clientHello *tls.ClientHelloInfo
-		clientHello, newReader, err = peekClientHello(reader)
+		clientHello, ech, newReader, err = peekClientHello(reader)
 
 		if err != nil {
-			return "", nil, err
+			return "", nil, nil, err
 		}
 
 		serverName = clientHello.ServerName
 	}
 
-	return serverName, newReader, nil
+	return serverName, ech, newReader, nil
 }
 
 // peekHTTPHost peeks on the first bytes from the reader and tries to parse the
-// HTTP Host header.  Once it's done, it returns the hostname and a new reader
-// that contains unmodified data.
+// HTTP Host header or, if the client uses HTTP/2 with prior knowledge (h2c),
+// the :authority of the first request.  Once it's done, it returns the
+// hostname and a new reader that contains unmodified data.
 func peekHTTPHost(reader io.Reader) (host string, newReader io.Reader, err error) {
 	peekedBytes := new(bytes.Buffer)
 	teeReader := bufio.NewReader(io.TeeReader(reader, peekedBytes))
 
+	if isH2C(teeReader) {
+		host, err = readH2CAuthority(teeReader)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return host, io.MultiReader(peekedBytes, reader), nil
+	}
+
 	r, err := http.ReadRequest(teeReader)
 	if err != nil {
 		return "", nil, fmt.Errorf("gorao: failed to read http request: %w", err)
@@ -392,18 +988,21 @@ func peekHTTPHost(reader io.Reader) (host string, newReader io.Reader, err error
 }
 
 // peekClientHello peeks on the first bytes from the reader and tries to parse
-// the TLS ClientHello.  Once it's done, it returns the client hello information
-// and a new reader that contains unmodified data.
+// the TLS ClientHello.  Once it's done, it returns the client hello
+// information, the information about its ECH extension if there is one, and a
+// new reader that contains unmodified data.
 func peekClientHello(
 	reader io.Reader,
-) (hello *tls.ClientHelloInfo, newReader io.Reader, err error) {
+) (hello *tls.ClientHelloInfo, ech *echInfo, newReader io.Reader, err error) {
 	peekedBytes := new(bytes.Buffer)
 	hello, err = readClientHello(io.TeeReader(reader, peekedBytes))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return hello, io.MultiReader(peekedBytes, reader), nil
+	ech = parseECH(peekedBytes.Bytes())
+
+	return hello, ech, io.MultiReader(peekedBytes, reader), nil
 }
 
 // readClientHello reads client hello information from the specified reader.
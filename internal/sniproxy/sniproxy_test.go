@@ -0,0 +1,29 @@
+package gorao
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGorao_Close(t *testing.T) {
+	p, err := New(&Config{
+		Listeners: []*ListenerConfig{{
+			Name:  "tls",
+			Proto: ProtocolTLS,
+			Addr:  &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		if err = p.Close(); err != nil {
+			t.Fatalf("close %d: %v", i, err)
+		}
+	}
+}
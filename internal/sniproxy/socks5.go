@@ -0,0 +1,313 @@
+package gorao
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksPasswordVersion = 0x01
+	socksPasswordOK      = 0x00
+	socksPasswordFailure = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyFailure             = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCmdNotSupported     = 0x07
+	socksReplyAddrTypeUnsupported = 0x08
+)
+
+// serveSOCKS5 handles the SOCKS5 handshake of the client connection, applies
+// the rules to the requested target and tunnels the connection there.  Only
+// the CONNECT command is supported.
+func (p *Gorao) serveSOCKS5(clientConn net.Conn, l *listener) (err error) {
+	err = socksAuthenticate(clientConn, l)
+	if err != nil {
+		err = nameTimeout(err, "read", p.readTimeout)
+
+		return fmt.Errorf("gorao: listener %s: socks5 handshake with %s: %w", l.name, clientConn.RemoteAddr(), err)
+	}
+
+	host, err := readSOCKSRequest(clientConn)
+	if err != nil {
+		err = nameTimeout(err, "read", p.readTimeout)
+
+		return fmt.Errorf("gorao: listener %s: socks5 request from %s: %w", l.name, clientConn.RemoteAddr(), err)
+	}
+
+	if err = clientConn.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("gorao: failed to remove read deadline: %w", err)
+	}
+
+	ctx, ok := p.newContext(l, clientConn, host, netip.AddrPort{})
+	if !ok {
+		writeSOCKSReply(clientConn, socksReplyNotAllowed, nil)
+
+		return nil
+	}
+
+	log.Info(
+		"gorao: [%d] start tunneling from %s to %s via %s",
+		ctx.ID,
+		ctx.ClientAddr,
+		ctx.RemoteAddr,
+		ctx.Upstream,
+	)
+
+	if _, blocked := p.blocked(ctx); blocked {
+		writeSOCKSReply(clientConn, socksReplyNotAllowed, nil)
+
+		return nil
+	}
+
+	releaseHost, ok := p.admitHost(ctx, clientConn, l.proto)
+	if !ok {
+		return nil
+	}
+	defer releaseHost()
+
+	if p.dropped(ctx, clientConn) {
+		return nil
+	}
+
+	backendConn, err := p.connect(ctx)
+	if err != nil {
+		writeSOCKSReply(clientConn, socksReplyCode(err), nil)
+
+		if errors.Is(err, errLoop) {
+			return nil
+		}
+
+		return err
+	}
+	defer log.OnCloserError(backendConn, log.DEBUG)
+	defer p.untrackConn(backendConn)
+
+	err = writeSOCKSReply(clientConn, socksReplySucceeded, backendConn.LocalAddr())
+	if err != nil {
+		return fmt.Errorf("gorao: [%d] failed to write socks5 reply: %w", ctx.ID, err)
+	}
+
+	p.relay(ctx, clientConn, clientConn, backendConn)
+
+	return nil
+}
+
+// socksAuthenticate negotiates the authentication method with the client and
+// checks its username and password if the listener requires them.
+func socksAuthenticate(conn net.Conn, l *listener) (err error) {
+	// VER, NMETHODS.
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unsupported version %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	method := byte(socksAuthNone)
+	if l.auth != nil {
+		method = socksAuthPassword
+	}
+
+	found := false
+	for _, m := range methods {
+		found = found || m == method
+	}
+
+	if !found {
+		_, _ = conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+
+		return errors.New("no acceptable authentication method")
+	}
+
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+
+	if method == socksAuthNone {
+		return nil
+	}
+
+	user, pass, err := readSOCKSPassword(conn)
+	if err != nil {
+		return err
+	}
+
+	wantPass, _ := l.auth.Password()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(l.auth.Username())) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+	if !userOK || !passOK {
+		_, _ = conn.Write([]byte{socksPasswordVersion, socksPasswordFailure})
+
+		return errors.New("authentication failed")
+	}
+
+	_, err = conn.Write([]byte{socksPasswordVersion, socksPasswordOK})
+
+	return err
+}
+
+// readSOCKSPassword reads the username/password authentication request.
+func readSOCKSPassword(r io.Reader) (user, pass string, err error) {
+	ver := make([]byte, 1)
+	if _, err = io.ReadFull(r, ver); err != nil {
+		return "", "", err
+	}
+
+	if ver[0] != socksPasswordVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", ver[0])
+	}
+
+	if user, err = readSOCKSString(r); err != nil {
+		return "", "", err
+	}
+
+	if pass, err = readSOCKSString(r); err != nil {
+		return "", "", err
+	}
+
+	return user, pass, nil
+}
+
+// readSOCKSString reads a string prefixed with a single-byte length.
+func readSOCKSString(r io.Reader) (s string, err error) {
+	n := make([]byte, 1)
+	if _, err = io.ReadFull(r, n); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n[0])
+	if _, err = io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// readSOCKSRequest reads the SOCKS5 request and returns its target as
+// host:port.  If the request isn't supported, the reply is sent to the client
+// before returning an error.
+func readSOCKSRequest(conn net.Conn) (host string, err error) {
+	// VER, CMD, RSV, ATYP.
+	hdr := make([]byte, 4)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return "", err
+	}
+
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version %d", hdr[0])
+	}
+
+	if hdr[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksReplyCmdNotSupported, nil)
+
+		return "", fmt.Errorf("unsupported command %d", hdr[1])
+	}
+
+	switch hdr[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		b := make([]byte, net.IPv4len)
+		if hdr[3] == socksAddrIPv6 {
+			b = make([]byte, net.IPv6len)
+		}
+
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+
+		ip, _ := netip.AddrFromSlice(b)
+		host = ip.String()
+	case socksAddrDomain:
+		if host, err = readSOCKSString(conn); err != nil {
+			return "", err
+		}
+	default:
+		writeSOCKSReply(conn, socksReplyAddrTypeUnsupported, nil)
+
+		return "", fmt.Errorf("unsupported address type %d", hdr[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return netutil.JoinHostPort(host, binary.BigEndian.Uint16(port)), nil
+}
+
+// writeSOCKSReply sends the SOCKS5 reply with the bound address addr to the
+// client.  If addr is nil or not an IP address, e.g. the address of a Unix
+// socket, the unspecified IPv4 address is sent.
+func writeSOCKSReply(w io.Writer, code byte, addr net.Addr) (err error) {
+	bound := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if a := netutil.NetAddrToAddrPort(addr); a.IsValid() {
+		bound = a
+	}
+
+	ip := bound.Addr().Unmap()
+
+	atyp := byte(socksAddrIPv4)
+	if ip.Is6() {
+		atyp = socksAddrIPv6
+	}
+
+	b := []byte{socksVersion, code, 0x00, atyp}
+	b = append(b, ip.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, bound.Port())
+
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug("gorao: failed to write socks5 reply: %v", err)
+	}
+
+	return err
+}
+
+// socksReplyCode returns the SOCKS5 reply code for the error of connecting to
+// the target.
+func socksReplyCode(err error) (code byte) {
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, errLoop):
+		return socksReplyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socksReplyHostUnreachable
+	default:
+		return socksReplyFailure
+	}
+}
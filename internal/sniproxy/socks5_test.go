@@ -0,0 +1,217 @@
+package gorao
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testConn is a [net.Conn] that reads from r and writes to w.  Only Read and
+// Write are implemented.
+type testConn struct {
+	net.Conn
+
+	r io.Reader
+	w *bytes.Buffer
+}
+
+// newTestConn returns a *testConn that reads in.
+func newTestConn(in []byte) (c *testConn) {
+	return &testConn{r: bytes.NewReader(in), w: &bytes.Buffer{}}
+}
+
+// Read implements the [net.Conn] interface for *testConn.
+func (c *testConn) Read(b []byte) (n int, err error) { return c.r.Read(b) }
+
+// Write implements the [net.Conn] interface for *testConn.
+func (c *testConn) Write(b []byte) (n int, err error) { return c.w.Write(b) }
+
+func TestReadSOCKSRequest(t *testing.T) {
+	testCases := []struct {
+		name      string
+		in        []byte
+		want      string
+		wantErr   string
+		wantReply []byte
+	}{{
+		name: "ipv4",
+		in:   []byte{5, 1, 0, 1, 1, 2, 3, 4, 0x01, 0xbb},
+		want: "1.2.3.4:443",
+	}, {
+		name: "ipv6",
+		in: []byte{
+			5, 1, 0, 4,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x00, 0x50,
+		},
+		want: "[2001:db8::1]:80",
+	}, {
+		name: "domain",
+		in:   append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0x01, 0xbb),
+		want: "example.com:443",
+	}, {
+		name:    "bad_version",
+		in:      []byte{4, 1, 0, 1, 1, 2, 3, 4, 0x01, 0xbb},
+		wantErr: "unsupported version 4",
+	}, {
+		name:      "bind",
+		in:        []byte{5, 2, 0, 1, 1, 2, 3, 4, 0x01, 0xbb},
+		wantErr:   "unsupported command 2",
+		wantReply: []byte{5, socksReplyCmdNotSupported, 0, 1, 0, 0, 0, 0, 0, 0},
+	}, {
+		name:      "udp_associate",
+		in:        []byte{5, 3, 0, 1, 1, 2, 3, 4, 0x01, 0xbb},
+		wantErr:   "unsupported command 3",
+		wantReply: []byte{5, socksReplyCmdNotSupported, 0, 1, 0, 0, 0, 0, 0, 0},
+	}, {
+		name:      "bad_address_type",
+		in:        []byte{5, 1, 0, 2, 1, 2, 3, 4, 0x01, 0xbb},
+		wantErr:   "unsupported address type 2",
+		wantReply: []byte{5, socksReplyAddrTypeUnsupported, 0, 1, 0, 0, 0, 0, 0, 0},
+	}, {
+		name:    "truncated_header",
+		in:      []byte{5, 1},
+		wantErr: "unexpected EOF",
+	}, {
+		name:    "truncated_ipv4",
+		in:      []byte{5, 1, 0, 1, 1, 2},
+		wantErr: "unexpected EOF",
+	}, {
+		name:    "truncated_domain",
+		in:      append([]byte{5, 1, 0, 3, 11}, "example"...),
+		wantErr: "unexpected EOF",
+	}, {
+		name:    "missing_port",
+		in:      []byte{5, 1, 0, 1, 1, 2, 3, 4},
+		wantErr: "EOF",
+	}, {
+		name:    "empty",
+		in:      nil,
+		wantErr: "EOF",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := newTestConn(tc.in)
+			host, err := readSOCKSRequest(conn)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if host != tc.want {
+				t.Fatalf("got host %q, want %q", host, tc.want)
+			}
+
+			if got := conn.w.Bytes(); !bytes.Equal(got, tc.wantReply) {
+				t.Fatalf("got reply %v, want %v", got, tc.wantReply)
+			}
+		})
+	}
+}
+
+func TestSOCKSAuthenticate(t *testing.T) {
+	// passwordReq returns the username/password authentication request.
+	passwordReq := func(user, pass string) (b []byte) {
+		b = append([]byte{socksPasswordVersion, byte(len(user))}, user...)
+		b = append(b, byte(len(pass)))
+
+		return append(b, pass...)
+	}
+
+	noAuth := &listener{}
+	withAuth := &listener{auth: url.UserPassword("user", "pass")}
+
+	testCases := []struct {
+		l         *listener
+		name      string
+		in        []byte
+		wantErr   string
+		wantReply []byte
+	}{{
+		l:         noAuth,
+		name:      "no_auth",
+		in:        []byte{5, 1, socksAuthNone},
+		wantReply: []byte{5, socksAuthNone},
+	}, {
+		l:         noAuth,
+		name:      "no_auth_among_methods",
+		in:        []byte{5, 2, socksAuthPassword, socksAuthNone},
+		wantReply: []byte{5, socksAuthNone},
+	}, {
+		l:         noAuth,
+		name:      "no_acceptable_method",
+		in:        []byte{5, 1, socksAuthPassword},
+		wantErr:   "no acceptable authentication method",
+		wantReply: []byte{5, socksAuthNoAcceptable},
+	}, {
+		l:       noAuth,
+		name:    "bad_version",
+		in:      []byte{4, 1, socksAuthNone},
+		wantErr: "unsupported version 4",
+	}, {
+		l:       noAuth,
+		name:    "truncated_methods",
+		in:      []byte{5, 3, socksAuthNone},
+		wantErr: "unexpected EOF",
+	}, {
+		l:         withAuth,
+		name:      "password",
+		in:        append([]byte{5, 1, socksAuthPassword}, passwordReq("user", "pass")...),
+		wantReply: []byte{5, socksAuthPassword, socksPasswordVersion, socksPasswordOK},
+	}, {
+		l:         withAuth,
+		name:      "wrong_password",
+		in:        append([]byte{5, 1, socksAuthPassword}, passwordReq("user", "wrong")...),
+		wantErr:   "authentication failed",
+		wantReply: []byte{5, socksAuthPassword, socksPasswordVersion, socksPasswordFailure},
+	}, {
+		l:         withAuth,
+		name:      "wrong_user",
+		in:        append([]byte{5, 1, socksAuthPassword}, passwordReq("other", "pass")...),
+		wantErr:   "authentication failed",
+		wantReply: []byte{5, socksAuthPassword, socksPasswordVersion, socksPasswordFailure},
+	}, {
+		l:         withAuth,
+		name:      "password_required",
+		in:        []byte{5, 1, socksAuthNone},
+		wantErr:   "no acceptable authentication method",
+		wantReply: []byte{5, socksAuthNoAcceptable},
+	}, {
+		l:         withAuth,
+		name:      "bad_password_version",
+		in:        []byte{5, 1, socksAuthPassword, 2, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+		wantErr:   "unsupported auth version 2",
+		wantReply: []byte{5, socksAuthPassword},
+	}, {
+		l:         withAuth,
+		name:      "truncated_password",
+		in:        []byte{5, 1, socksAuthPassword, socksPasswordVersion, 4, 'u', 's', 'e', 'r', 4, 'p'},
+		wantErr:   "unexpected EOF",
+		wantReply: []byte{5, socksAuthPassword},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := newTestConn(tc.in)
+			err := socksAuthenticate(conn, tc.l)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := conn.w.Bytes(); !bytes.Equal(got, tc.wantReply) {
+				t.Fatalf("got reply %v, want %v", got, tc.wantReply)
+			}
+		})
+	}
+}
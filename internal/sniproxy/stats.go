@@ -0,0 +1,60 @@
+package gorao
+
+import (
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Stats contains the counters of notable connection events.
+type Stats struct {
+	// Loops is the number of connections that were refused because their
+	// destination pointed to gorao itself.
+	Loops uint64
+
+	// NoServerName is the number of connections without a server name or with
+	// a TLS server name that is an IP address.
+	NoServerName uint64
+
+	// LimitedTotal, LimitedClient and LimitedHost are the numbers of
+	// connections rejected because of the total, per-client and per-host caps
+	// on concurrent connections.
+	LimitedTotal  uint64
+	LimitedClient uint64
+	LimitedHost   uint64
+}
+
+// counters contains the counters the proxy updates while it is working.
+type counters struct {
+	loops         atomic.Uint64
+	noServerName  atomic.Uint64
+	limitedTotal  atomic.Uint64
+	limitedClient atomic.Uint64
+	limitedHost   atomic.Uint64
+}
+
+// Stats returns the current values of the proxy counters.
+func (p *Gorao) Stats() (s Stats) {
+	return Stats{
+		Loops:         p.counters.loops.Load(),
+		NoServerName:  p.counters.noServerName.Load(),
+		LimitedTotal:  p.counters.limitedTotal.Load(),
+		LimitedClient: p.counters.limitedClient.Load(),
+		LimitedHost:   p.counters.limitedHost.Load(),
+	}
+}
+
+// logStats writes the current values of the proxy counters to the log.
+func (p *Gorao) logStats() {
+	s := p.Stats()
+
+	log.Info(
+		"gorao: stats: loops refused: %d, connections without server name: %d, "+
+			"rejected by limits: total %d, per client %d, per host %d",
+		s.Loops,
+		s.NoServerName,
+		s.LimitedTotal,
+		s.LimitedClient,
+		s.LimitedHost,
+	)
+}
@@ -0,0 +1,365 @@
+package gorao
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/zamibd/gorao/internal/fault"
+)
+
+// timeoutError is returned when a read deadline or a connect timeout has been
+// exceeded.  It names the timeout so that it's clear from the logs which one
+// has fired.
+type timeoutError struct {
+	err     error
+	name    string
+	timeout time.Duration
+}
+
+// type check
+var _ error = (*timeoutError)(nil)
+
+// Error implements the error interface for *timeoutError.
+func (e *timeoutError) Error() (s string) {
+	return fmt.Sprintf("%s timeout of %v exceeded: %v", e.name, e.timeout, e.err)
+}
+
+// Unwrap implements the errors.Unwrap interface for *timeoutError.
+func (e *timeoutError) Unwrap() (err error) {
+	return e.err
+}
+
+// nameTimeout wraps err into *timeoutError with the name and the value of the
+// timeout if err is caused by an exceeded deadline and the timeout isn't named
+// yet.  Otherwise, it returns err as is.
+func nameTimeout(err error, name string, timeout time.Duration) (res error) {
+	var tErr *timeoutError
+	if !errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &tErr) {
+		return err
+	}
+
+	return &timeoutError{
+		err:     err,
+		name:    name,
+		timeout: timeout,
+	}
+}
+
+// requestReadTimeout returns the read timeout of the request of ctx and true
+// if a read timeout rule matches ctx.
+func (p *Gorao) requestReadTimeout(ctx *SNIContext) (timeout time.Duration, ok bool) {
+	timeout, _, ok = p.readTimeoutRules.Match(ctx.target())
+
+	return timeout, ok && timeout > 0
+}
+
+// readTimeoutBody returns the body that has to be read from conn within
+// timeout on every read.  http.NoBody is returned as is.
+func readTimeoutBody(conn net.Conn, body io.ReadCloser, timeout time.Duration) (res io.ReadCloser) {
+	if body == http.NoBody {
+		return body
+	}
+
+	return &deadlineBody{
+		ReadCloser: body,
+		conn:       conn,
+		timeout:    timeout,
+	}
+}
+
+// deadlineBody sets the read deadline of the client connection before every
+// read of the request body.
+type deadlineBody struct {
+	io.ReadCloser
+
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// type check
+var _ io.ReadCloser = (*deadlineBody)(nil)
+
+// Read implements the [io.Reader] interface for *deadlineBody.
+func (b *deadlineBody) Read(p []byte) (n int, err error) {
+	if err = b.conn.SetReadDeadline(time.Now().Add(b.timeout)); err != nil {
+		return 0, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
+	n, err = b.ReadCloser.Read(p)
+
+	return n, nameTimeout(err, "read", b.timeout)
+}
+
+// backendResponseTimeout returns the time the backend of ctx has to send the
+// first bytes of its response within and true if a backend response timeout
+// rule matches ctx.
+func (p *Gorao) backendResponseTimeout(ctx *SNIContext) (timeout time.Duration, ok bool) {
+	timeout, _, ok = p.backendResponseTimeoutRules.Match(ctx.target())
+
+	return timeout, ok && timeout > 0
+}
+
+// backendReader returns the reader of the backend connection of ctx.  If a
+// backend response timeout rule matches the connection, the backend has to
+// send its first bytes within that timeout, otherwise the tunnel is closed.
+func (p *Gorao) backendReader(ctx *SNIContext, backendConn net.Conn) (r io.Reader) {
+	timeout, ok := p.backendResponseTimeout(ctx)
+	if !ok {
+		return backendConn
+	}
+
+	if err := backendConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		log.Debug("gorao: [%d] failed to set backend read deadline: %v", ctx.ID, err)
+
+		return backendConn
+	}
+
+	return &firstReadReader{
+		ctx:     ctx,
+		conn:    backendConn,
+		timeout: timeout,
+	}
+}
+
+// firstReadReader removes the read deadline of the backend connection once its
+// first bytes are read.
+type firstReadReader struct {
+	ctx     *SNIContext
+	conn    net.Conn
+	timeout time.Duration
+	done    bool
+}
+
+// type check
+var _ io.Reader = (*firstReadReader)(nil)
+
+// Read implements the [io.Reader] interface for *firstReadReader.
+func (r *firstReadReader) Read(b []byte) (n int, err error) {
+	n, err = r.conn.Read(b)
+	if r.done {
+		return n, err
+	}
+
+	if n > 0 {
+		r.done = true
+		if dErr := r.conn.SetReadDeadline(time.Time{}); dErr != nil {
+			log.Debug("gorao: [%d] failed to remove backend read deadline: %v", r.ctx.ID, dErr)
+		}
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = nameTimeout(err, "backend response", r.timeout)
+		log.Info("gorao: [%d] no response from %s: %v", r.ctx.ID, r.ctx.RemoteAddr, err)
+	}
+
+	return n, err
+}
+
+// tunnelLimits returns the idle timeout, the maximum lifetime and the TCP
+// keepalive period of the tunnel of ctx.  The per-rule values override the
+// global ones, zero timeouts mean no limit and zero keepalive means the
+// system default.
+func (p *Gorao) tunnelLimits(ctx *SNIContext) (idle, lifetime, keepAlive time.Duration) {
+	t := ctx.target()
+
+	idle, _, ok := p.idleTimeoutRules.Match(t)
+	if !ok {
+		idle = p.idleTimeout
+	}
+
+	lifetime, _, ok = p.maxLifetimeRules.Match(t)
+	if !ok {
+		lifetime = p.maxLifetime
+	}
+
+	keepAlive, _, ok = p.keepAliveRules.Match(t)
+	if !ok {
+		keepAlive = p.keepAlive
+	}
+
+	return idle, lifetime, keepAlive
+}
+
+// tunnelTimers closes both sides of a tunnel once no data has been
+// transferred in either direction for the idle timeout, once the tunnel has
+// reached its maximum lifetime or once its trickle period is over.  It also
+// resets the tunnel with the reset-after fault injected.
+type tunnelTimers struct {
+	ctx   *SNIContext
+	conns []net.Conn
+
+	// lastActive is the time of the last read from either side in unix
+	// nanoseconds.
+	lastActive atomic.Int64
+
+	idleTimeout time.Duration
+
+	// mu protects the fields below.
+	mu        sync.Mutex
+	idleTimer *time.Timer
+	timers    []*time.Timer
+	stopped   bool
+}
+
+// startTimers starts the timers of the tunnel of ctx between clientConn and
+// backendConn and sets their TCP keepalive.  The caller must wrap the readers
+// of the tunnel with t.reader and call t.stop once the tunnel is finished.
+func (p *Gorao) startTimers(ctx *SNIContext, clientConn, backendConn net.Conn) (t *tunnelTimers) {
+	idle, lifetime, keepAlive := p.tunnelLimits(ctx)
+
+	if keepAlive != 0 {
+		setKeepAlive(ctx, clientConn, keepAlive)
+		setKeepAlive(ctx, backendConn, keepAlive)
+	}
+
+	t = &tunnelTimers{
+		ctx:         ctx,
+		conns:       []net.Conn{clientConn, backendConn},
+		idleTimeout: idle,
+	}
+	t.touch()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if idle > 0 {
+		t.idleTimer = time.AfterFunc(idle, t.checkIdle)
+		t.timers = append(t.timers, t.idleTimer)
+	}
+
+	if lifetime > 0 {
+		t.closeAfter(lifetime, "maximum lifetime is reached", false)
+	}
+
+	if ctx.Trickle > 0 {
+		t.closeAfter(ctx.Trickle, "trickle period is over", false)
+	}
+
+	if f, ok := ctx.fault(fault.ResetAfter); ok {
+		t.closeAfter(f.Period, "reset by fault injection", true)
+	}
+
+	return t
+}
+
+// closeAfter closes the tunnel after d.  If rst is true, the tunnel is reset
+// with a TCP RST.  t.mu must be locked.
+func (t *tunnelTimers) closeAfter(d time.Duration, reason string, rst bool) {
+	t.timers = append(t.timers, time.AfterFunc(d, func() { t.close(reason, rst) }))
+}
+
+// checkIdle closes the tunnel if it has been idle for the idle timeout and
+// rearms the idle timer otherwise.
+func (t *tunnelTimers) checkIdle() {
+	idle := time.Since(time.Unix(0, t.lastActive.Load()))
+	if idle >= t.idleTimeout {
+		t.close("idle timeout is reached", false)
+
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.stopped {
+		t.idleTimer.Reset(t.idleTimeout - idle)
+	}
+}
+
+// close closes both sides of the tunnel.  If rst is true, they are reset with
+// a TCP RST.
+func (t *tunnelTimers) close(reason string, rst bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+
+	t.stopped = true
+
+	log.Debug("gorao: [%d] closing tunnel: %s", t.ctx.ID, reason)
+
+	for _, conn := range t.conns {
+		if rst {
+			setLingerZero(conn)
+		}
+
+		log.OnCloserError(conn, log.DEBUG)
+	}
+}
+
+// stop stops the timers.
+func (t *tunnelTimers) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopped = true
+	for _, timer := range t.timers {
+		timer.Stop()
+	}
+}
+
+// touch marks the tunnel as active.
+func (t *tunnelTimers) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// reader returns a reader that marks the tunnel as active on every read from
+// r.
+func (t *tunnelTimers) reader(r io.Reader) (res io.Reader) {
+	if t.idleTimeout <= 0 {
+		return r
+	}
+
+	return &activityReader{r: r, t: t}
+}
+
+// activityReader marks the tunnel as active on every successful read.
+type activityReader struct {
+	r io.Reader
+	t *tunnelTimers
+}
+
+// type check
+var _ io.Reader = (*activityReader)(nil)
+
+// Read implements the [io.Reader] interface for *activityReader.
+func (a *activityReader) Read(b []byte) (n int, err error) {
+	n, err = a.r.Read(b)
+	if n > 0 {
+		a.t.touch()
+	}
+
+	return n, err
+}
+
+// keepAliver is implemented by the connections which TCP keepalive can be
+// configured, e.g. *net.TCPConn.
+type keepAliver interface {
+	SetKeepAliveConfig(cfg net.KeepAliveConfig) (err error)
+}
+
+// setKeepAlive sets the TCP keepalive period of conn.  A negative period
+// disables keepalive.
+func setKeepAlive(ctx *SNIContext, conn net.Conn, period time.Duration) {
+	ka, ok := conn.(keepAliver)
+	if !ok {
+		return
+	}
+
+	err := ka.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   period > 0,
+		Idle:     period,
+		Interval: period,
+	})
+	if err != nil {
+		log.Debug("gorao: [%d] failed to set keepalive: %v", ctx.ID, err)
+	}
+}
@@ -0,0 +1,89 @@
+package gorao
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGorao_readTimeoutRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	t.Cleanup(backend.Close)
+
+	p, err := New(&Config{
+		Listeners: []*ListenerConfig{{
+			Name:     "http",
+			Proto:    ProtocolHTTP,
+			Addr:     &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+			HTTPMode: HTTPModeRequest,
+		}},
+		BackendRules: map[string]string{
+			"*.example": backend.Listener.Addr().String(),
+		},
+		ReadTimeoutRules: map[string]time.Duration{
+			"slow.example": 100 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+
+	testCases := []struct {
+		name       string
+		in         string
+		wantClosed bool
+	}{{
+		name:       "body",
+		in:         "POST / HTTP/1.1\r\nHost: slow.example\r\nContent-Length: 10\r\n\r\nhalf!",
+		wantClosed: true,
+	}, {
+		name:       "body_no_rule",
+		in:         "POST / HTTP/1.1\r\nHost: fast.example\r\nContent-Length: 10\r\n\r\nhalf!",
+		wantClosed: false,
+	}, {
+		name:       "next_headers",
+		in:         "GET / HTTP/1.1\r\nHost: slow.example\r\n\r\nGET / HTTP/1.1\r\n",
+		wantClosed: true,
+	}, {
+		name:       "next_headers_no_rule",
+		in:         "GET / HTTP/1.1\r\nHost: fast.example\r\n\r\nGET / HTTP/1.1\r\n",
+		wantClosed: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, dErr := net.Dial("tcp", p.listeners[0].Addr().String())
+			if dErr != nil {
+				t.Fatal(dErr)
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+
+			if _, err = io.WriteString(conn, tc.in); err != nil {
+				t.Fatal(err)
+			}
+
+			// Skip the response to the complete request, if any.
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			r := bufio.NewReader(conn)
+			if resp, rErr := http.ReadResponse(r, nil); rErr == nil {
+				_ = resp.Body.Close()
+			}
+
+			_, err = r.ReadByte()
+			if closed := err == io.EOF; closed != tc.wantClosed {
+				t.Fatalf("got error %v, want closed %t", err, tc.wantClosed)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package gorao
+
+import (
+	"github.com/zamibd/gorao/internal/filter"
+)
+
+// useOriginalDst returns true if the connection accepted by a transparent
+// listener should be tunneled to its original destination address instead of
+// the server name.  This is the case when the connection was sent to a
+// non-standard port, so the server name may belong to another service, or
+// when there is a matching original destination rule.  The connections
+// without a server name are handled by handleNoServerName.
+func (p *Gorao) useOriginalDst(ctx *SNIContext) (ok bool) {
+	if !ctx.OriginalDst.IsValid() {
+		return false
+	}
+
+	if port := ctx.OriginalDst.Port(); port != remotePortPlain && port != remotePortTLS {
+		return true
+	}
+
+	_, ok = filter.MatchRules(ctx.target(), p.originalDstRules)
+
+	return ok
+}
@@ -0,0 +1,286 @@
+package gorao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zamibd/gorao/internal/filter"
+	"github.com/zamibd/gorao/internal/httpupstream"
+	"github.com/zamibd/gorao/internal/proxypool"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// UpstreamDirect is the name of the pseudo-upstream that means connecting
+	// to the remote host directly.
+	UpstreamDirect = "direct"
+
+	// UpstreamDefault is the name of the upstream created from
+	// Config.ForwardProxy.
+	UpstreamDefault = "default"
+)
+
+// newUpstreams creates the named proxy dialers from the configuration.  The
+// upstreams with several comma-separated URLs become pools, they are also
+// returned separately so that their health checks could be started.
+func newUpstreams(
+	cfg *Config,
+	dialer proxy.Dialer,
+) (upstreams map[string]proxy.Dialer, pools []*proxypool.Pool, err error) {
+	upstreams = map[string]proxy.Dialer{}
+
+	proxies := map[string]string{}
+	for name, addr := range cfg.ForwardProxies {
+		// The default upstream forwards all unmatched connections, so it can
+		// only be created from Config.ForwardProxy.
+		if name == UpstreamDirect || name == UpstreamDefault {
+			return nil, nil, fmt.Errorf("gorao: upstream name %q is reserved", name)
+		}
+
+		proxies[name] = addr
+	}
+
+	if cfg.ForwardProxy != "" {
+		proxies[UpstreamDefault] = cfg.ForwardProxy
+	}
+
+	for name, addr := range proxies {
+		addrs := strings.Split(addr, ",")
+		if len(addrs) == 1 {
+			upstreams[name], err = newProxyDialer(addr, dialer)
+			if err != nil {
+				return nil, nil, fmt.Errorf("gorao: upstream %s: %w", name, err)
+			}
+
+			continue
+		}
+
+		var pool *proxypool.Pool
+		pool, err = newProxyPool(cfg, name, addrs, dialer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("gorao: upstream %s: %w", name, err)
+		}
+
+		upstreams[name] = pool
+		pools = append(pools, pool)
+	}
+
+	for w, name := range cfg.ForwardRoutes {
+		if _, ok := upstreams[name]; !ok && name != UpstreamDirect {
+			return nil, nil, fmt.Errorf(
+				"gorao: forward route %s refers to unknown upstream %q",
+				w,
+				name,
+			)
+		}
+	}
+
+	return upstreams, pools, nil
+}
+
+// newProxyPool creates a pool of proxies from the list of proxy URLs.
+func newProxyPool(
+	cfg *Config,
+	name string,
+	addrs []string,
+	dialer proxy.Dialer,
+) (pool *proxypool.Pool, err error) {
+	strategy, ok := cfg.ForwardPoolStrategies[name]
+	if !ok {
+		strategy = proxypool.RoundRobin
+	}
+
+	poolCfg := &proxypool.Config{
+		Dialer:        dialer,
+		Name:          name,
+		Strategy:      strategy,
+		Probe:         cfg.ForwardHealthCheckProbe,
+		CheckInterval: cfg.ForwardHealthCheckInterval,
+	}
+
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+
+		var u *url.URL
+		u, err = url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse forward-proxy %s: %w", redactURL(addr), err)
+		}
+
+		m := &proxypool.Member{
+			Name: u.Redacted(),
+			Addr: proxyHostPort(u),
+		}
+
+		var d proxy.Dialer
+		d, err = newProxyDialer(addr, dialer)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Dialer = &memberDialer{dialer: d}
+
+		poolCfg.Members = append(poolCfg.Members, m)
+	}
+
+	return proxypool.New(poolCfg), nil
+}
+
+// memberDialer wraps the dialer of a pool member and turns the errors the
+// proxy reports about the target into *proxypool.TargetError, so that they
+// don't count as failures of the proxy.
+type memberDialer struct {
+	dialer proxy.Dialer
+}
+
+// type check
+var (
+	_ proxy.Dialer        = (*memberDialer)(nil)
+	_ proxy.ContextDialer = (*memberDialer)(nil)
+)
+
+// Dial implements the proxy.Dialer interface for *memberDialer.
+func (d *memberDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements the proxy.ContextDialer interface for *memberDialer.
+func (d *memberDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (conn net.Conn, err error) {
+	if cd, ok := d.dialer.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, network, addr)
+	} else {
+		conn, err = d.dialer.Dial(network, addr)
+	}
+
+	if err != nil && isTargetError(err) {
+		return nil, &proxypool.TargetError{Err: err}
+	}
+
+	return conn, err
+}
+
+// socksReplyErrPrefix is the prefix of the errors golang.org/x/net/proxy
+// returns when the SOCKS5 proxy replies to the CONNECT command with a failure.
+// They aren't exported, so they can only be told apart from the handshake
+// errors by the message.  TestIsTargetError pins it.
+const socksReplyErrPrefix = "unknown error "
+
+// isTargetError returns true if err is reported by a proxy that has accepted
+// the request but has failed to connect to the target.  Failures to reach the
+// proxy and rejected handshakes or credentials are failures of the proxy.
+func isTargetError(err error) (ok bool) {
+	if errors.Is(err, errLoop) {
+		return true
+	}
+
+	var sErr *httpupstream.StatusError
+	if errors.As(err, &sErr) {
+		return sErr.StatusCode != http.StatusProxyAuthRequired
+	}
+
+	// The SOCKS dialer returns *net.OpError with the command in Op, e.g.
+	// "socks connect", and the error of the exchange with the proxy in Err.
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !strings.HasPrefix(opErr.Op, "socks ") || opErr.Err == nil {
+		return false
+	}
+
+	return strings.HasPrefix(opErr.Err.Error(), socksReplyErrPrefix)
+}
+
+// proxyHostPort returns the address of the proxy from its URL using the
+// default port of the scheme if the port is not specified.
+func proxyHostPort(u *url.URL) (addr string) {
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			port = "1080"
+		}
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// newProxyDialer creates a proxy dialer from the proxy URL.
+func newProxyDialer(addr string, dialer proxy.Dialer) (d proxy.Dialer, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse forward-proxy %s: %w", redactURL(addr), err)
+	}
+
+	d, err = proxy.FromURL(u, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init forward-proxy %s: %w", u.Redacted(), err)
+	}
+
+	return d, nil
+}
+
+// redactURL returns addr with the password replaced if addr is a valid URL.
+func redactURL(addr string) (s string) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	return u.Redacted()
+}
+
+// route chooses the name of the upstream the connection will be tunneled
+// through.
+func (p *Gorao) route(ctx *SNIContext) (name string) {
+	if isUnixAddr(ctx.RemoteAddr) {
+		return UpstreamDirect
+	}
+
+	name, _, ok := p.forwardRoutes.Match(ctx.target())
+	if ok {
+		return name
+	}
+
+	if p.shouldForward(ctx) {
+		return UpstreamDefault
+	}
+
+	return UpstreamDirect
+}
+
+// upstreamDialer returns the dialer for the upstream with the specified name.
+func (p *Gorao) upstreamDialer(name string) (d proxy.Dialer) {
+	if name == UpstreamDirect {
+		return p.dialer
+	}
+
+	return p.upstreams[name]
+}
+
+// shouldForward checks if the connection should be forwarded to the default
+// upstream proxy according to the forward rules.
+func (p *Gorao) shouldForward(ctx *SNIContext) (ok bool) {
+	if p.upstreams[UpstreamDefault] == nil {
+		return false
+	}
+
+	if len(p.forwardRules) == 0 {
+		// forward all connections if there are no rules.
+		return true
+	}
+
+	_, ok = filter.MatchRules(ctx.target(), p.forwardRules)
+
+	return ok
+}
@@ -0,0 +1,161 @@
+package gorao
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/zamibd/gorao/internal/httpupstream"
+	"github.com/zamibd/gorao/internal/proxypool"
+)
+
+// newTestSOCKSServer starts a SOCKS5 server that accepts a single connection,
+// offers method to the client and replies to its request with reply.  It
+// returns the address of the server.
+func newTestSOCKSServer(t *testing.T, method, reply byte) (addr string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		conn, aErr := l.Accept()
+		if aErr != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		// The greeting with a single method.
+		if _, rErr := io.ReadFull(conn, make([]byte, 3)); rErr != nil {
+			return
+		}
+
+		if _, wErr := conn.Write([]byte{5, method}); wErr != nil || method != socksAuthNone {
+			return
+		}
+
+		// The CONNECT request with an IPv4 address.
+		if _, rErr := io.ReadFull(conn, make([]byte, 10)); rErr != nil {
+			return
+		}
+
+		_, _ = conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+	}()
+
+	return l.Addr().String()
+}
+
+func TestIsTargetError(t *testing.T) {
+	// socksErr returns the error of connecting through a SOCKS5 server that
+	// offers method and replies with reply.
+	socksErr := func(t *testing.T, method, reply byte) (err error) {
+		d, err := newProxyDialer("socks5://"+newTestSOCKSServer(t, method, reply), &net.Dialer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := d.Dial("tcp", "192.0.2.1:443")
+		if err == nil {
+			_ = conn.Close()
+			t.Fatal("no error")
+		}
+
+		return err
+	}
+
+	testCases := []struct {
+		err  func(t *testing.T) (err error)
+		name string
+		want bool
+	}{{
+		err:  func(t *testing.T) (err error) { return socksErr(t, socksAuthNone, 5) },
+		name: "socks_connection_refused",
+		want: true,
+	}, {
+		err:  func(t *testing.T) (err error) { return socksErr(t, socksAuthNone, 4) },
+		name: "socks_host_unreachable",
+		want: true,
+	}, {
+		err:  func(t *testing.T) (err error) { return socksErr(t, socksAuthNone, 1) },
+		name: "socks_general_failure",
+		want: true,
+	}, {
+		err:  func(t *testing.T) (err error) { return socksErr(t, socksAuthNoAcceptable, 0) },
+		name: "socks_no_acceptable_method",
+		want: false,
+	}, {
+		err: func(t *testing.T) (err error) {
+			l, lErr := net.Listen("tcp", "127.0.0.1:0")
+			if lErr != nil {
+				t.Fatal(lErr)
+			}
+
+			addr := l.Addr().String()
+			_ = l.Close()
+
+			d, dErr := newProxyDialer("socks5://"+addr, &net.Dialer{})
+			if dErr != nil {
+				t.Fatal(dErr)
+			}
+
+			_, err = d.Dial("tcp", "192.0.2.1:443")
+
+			return err
+		},
+		name: "socks_proxy_unreachable",
+		want: false,
+	}, {
+		err: func(_ *testing.T) (err error) {
+			return fmt.Errorf("wrapped: %w", &httpupstream.StatusError{StatusCode: http.StatusBadGateway})
+		},
+		name: "http_bad_gateway",
+		want: true,
+	}, {
+		err: func(_ *testing.T) (err error) {
+			return &httpupstream.StatusError{StatusCode: http.StatusProxyAuthRequired}
+		},
+		name: "http_auth_required",
+		want: false,
+	}, {
+		err:  func(_ *testing.T) (err error) { return fmt.Errorf("dial: %w", errLoop) },
+		name: "loop",
+		want: true,
+	}, {
+		err:  func(_ *testing.T) (err error) { return errors.New("unknown error connection refused") },
+		name: "not_socks",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.err(t)
+			if err == nil {
+				t.Fatal("no error")
+			}
+
+			if got := isTargetError(err); got != tc.want {
+				t.Fatalf("isTargetError(%v): got %t, want %t", err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemberDialer_targetError(t *testing.T) {
+	d, err := newProxyDialer("socks5://"+newTestSOCKSServer(t, socksAuthNone, 5), &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = (&memberDialer{dialer: d}).Dial("tcp", "192.0.2.1:443")
+
+	var tErr *proxypool.TargetError
+	if !errors.As(err, &tErr) {
+		t.Fatalf("got error %v, want *proxypool.TargetError", err)
+	}
+}